@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// accessInfo collects what the handlers learn about a request that the
+// access log needs once it is done
+type accessInfo struct {
+	app *App
+}
+
+type accessInfoKey struct{}
+
+// setAccessApp records the app the request was proxied to
+func setAccessApp(r *http.Request, app *App) {
+	if info, ok := r.Context().Value(accessInfoKey{}).(*accessInfo); ok {
+		info.app = app
+	}
+}
+
+// accessLog logs requests once they complete, sampling 1 in N of the
+// successful, fast ones (LOG_SAMPLE_RATE, or the app's LogSampleRate).
+// Errors and requests slower than LOG_SLOW_THRESHOLD are always logged. Each
+// line carries sample=N, the number of requests it stands for, so counts can
+// be extrapolated. With OTLP_ENDPOINT set, entries are also exported as
+// OpenTelemetry log records, or only there with OTLP_LOGS_ONLY.
+func accessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := &accessInfo{}
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(r.Context(), accessInfoKey{}, info)))
+		elapsed := time.Since(start)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		rate := config.LogSampleRate
+		if info.app != nil && info.app.LogSampleRate > 0 {
+			rate = info.app.LogSampleRate
+		}
+		important := status >= 400 || (config.LogSlowThreshold > 0 && elapsed >= config.LogSlowThreshold)
+		if important || rate <= 1 {
+			rate = 1
+		} else if rand.Intn(rate) != 0 {
+			return
+		}
+
+		line := fmt.Sprintf("%q from %s - %d %dB in %s sample=%d",
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, clientIP(r), status, ww.BytesWritten(), elapsed, rate)
+		if config.OTLPEndpoint != "" {
+			emitOTLPAccessLog(r, line, status, ww.BytesWritten(), elapsed, rate)
+			if config.OTLPLogsOnly {
+				return
+			}
+		}
+		log.Printf("[%s] %s", middleware.GetReqID(r.Context()), line)
+	})
+}
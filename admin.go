@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// adminRouter serves the management API. It is mounted under /admin, either on
+// its own listener (ADMIN_PORT) or on the main router.
+func adminRouter(store UsageStore) http.Handler {
+	r := chi.NewRouter()
+	r.Use(requireAdminToken(config.AdminToken))
+	r.NotFound(routeNotFound)
+	r.MethodNotAllowed(methodNotAllowed)
+
+	r.Get("/version", versionHandler)
+	r.Post("/keys", mintAPIKeyHandler(store))
+	r.Delete("/keys/{key}", revokeAPIKeyHandler(store))
+	r.Post("/dns/flush", flushDNSHandler)
+	r.Get("/usage", usageHandler)
+	r.Get("/usage/rollup", rollupHandler(store))
+	r.Get("/usage/{port}", appStatusHandler)
+	r.Get("/apps/{port}/blue-green", blueGreenHandler)
+	r.Post("/apps/{port}/switch", switchAppHandler(store))
+	return r
+}
+
+// mountProfiler serves net/http/pprof under /debug/pprof/ behind the admin
+// token. It has to sit at the router root because pprof resolves profile
+// names relative to /debug/pprof/.
+func mountProfiler(r chi.Router) {
+	r.Route("/debug", func(r chi.Router) {
+		r.Use(requireAdminToken(config.AdminToken))
+		r.Mount("/", middleware.Profiler())
+	})
+}
+
+// requireAdminToken only lets through requests carrying the admin bearer
+// token. With no token configured the admin API is closed.
+func requireAdminToken(token string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			got, ok := bearerToken(r)
+			if token == "" || !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// jsonError writes {"error": msg} with the given status
+func jsonError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error encoding response: %v", err)
+	}
+}
+
+type mintKeyRequest struct {
+	Principal string `json:"principal"`
+	Apps      []int  `json:"apps"`
+	// ExpiresIn is how long the new key is valid for, empty for no expiry
+	ExpiresIn string `json:"expires_in"`
+	// Overlap, when set, expires the principal's other keys after this
+	// long so old and new key are both accepted while clients switch over
+	Overlap string `json:"overlap"`
+	Tier    string `json:"tier"`
+	Tenant  string `json:"tenant"`
+}
+
+// mintAPIKeyHandler creates a new key for a principal (POST /admin/keys)
+func mintAPIKeyHandler(store UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req mintKeyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Principal == "" {
+			http.Error(w, "Invalid key request", http.StatusBadRequest)
+			return
+		}
+		var expiresIn, overlap time.Duration
+		var err error
+		if req.ExpiresIn != "" {
+			if expiresIn, err = time.ParseDuration(req.ExpiresIn); err != nil {
+				http.Error(w, "Invalid expires_in", http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Overlap != "" {
+			if overlap, err = time.ParseDuration(req.Overlap); err != nil {
+				http.Error(w, "Invalid overlap", http.StatusBadRequest)
+				return
+			}
+		}
+
+		key, err := newAPIKey()
+		if err != nil {
+			http.Error(w, "Error generating key", http.StatusInternalServerError)
+			return
+		}
+		now := time.Now()
+		key.Principal = req.Principal
+		key.Apps = req.Apps
+		key.Tier = req.Tier
+		key.Tenant = req.Tenant
+		if expiresIn > 0 {
+			key.ExpiresAt = now.Add(expiresIn)
+		}
+
+		ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+		defer cancel()
+		if err := store.InsertAPIKey(ctx, key); err != nil {
+			log.Printf("Error inserting API key: %v", err)
+			http.Error(w, "Error storing key", http.StatusInternalServerError)
+			return
+		}
+		if overlap > 0 {
+			if err := store.ExpireAPIKeys(ctx, req.Principal, key.Key, now.Add(overlap)); err != nil {
+				// Nothing was rotated, so the new key is taken back
+				log.Printf("Error expiring old API keys for %s: %v", req.Principal, err)
+				if _, err := store.DeleteAPIKey(ctx, key.Key); err != nil {
+					log.Printf("Error removing API key minted for %s: %v", req.Principal, err)
+				}
+				http.Error(w, "Error expiring old keys", http.StatusInternalServerError)
+				return
+			}
+		}
+
+		apiKeys.Lock()
+		for _, k := range apiKeys.Keys {
+			if overlap > 0 && k.Principal == req.Principal && (k.ExpiresAt.IsZero() || k.ExpiresAt.After(now.Add(overlap))) {
+				// Keys are shared with in-flight requests, so replace rather than mutate
+				old := *k
+				old.ExpiresAt = now.Add(overlap)
+				apiKeys.Keys[k.Key] = &old
+			}
+		}
+		apiKeys.Keys[key.Key] = key
+		apiKeys.Unlock()
+
+		writeJSON(w, http.StatusCreated, key)
+	}
+}
+
+// revokeAPIKeyHandler deletes a key so it stops working immediately
+// (DELETE /admin/keys/{key})
+func revokeAPIKeyHandler(store UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := chi.URLParam(r, "key")
+
+		ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+		defer cancel()
+		deleted, err := store.DeleteAPIKey(ctx, key)
+		if err != nil {
+			log.Printf("Error revoking API key: %v", err)
+			http.Error(w, "Error revoking key", http.StatusInternalServerError)
+			return
+		}
+
+		apiKeys.Lock()
+		_, known := apiKeys.Keys[key]
+		delete(apiKeys.Keys, key)
+		apiKeys.Unlock()
+
+		if !deleted && !known {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// flushDNSHandler empties the upstream DNS cache (POST /admin/dns/flush)
+func flushDNSHandler(w http.ResponseWriter, r *http.Request) {
+	upstreamDNS.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// failingExpiryStore is a memory store whose ExpireAPIKeys always fails
+type failingExpiryStore struct {
+	*memoryStore
+}
+
+func (s failingExpiryStore) ExpireAPIKeys(ctx context.Context, principal, keep string, cutoff time.Time) error {
+	return errors.New("store unavailable")
+}
+
+func TestRotateKeyFailsWhenOldKeysCannotExpire(t *testing.T) {
+	t.Setenv("STORAGE", "memory")
+	t.Setenv("ADMIN_TOKEN", testAdminToken)
+	store := failingExpiryStore{newMemoryStore("")}
+	s, err := NewServer(loadConfig(), store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gw := startServer(t, s)
+
+	old := mintKey(t, gw, `{"principal": "rotating"}`)
+	code := adminDo(t, gw, http.MethodPost, "/admin/keys", `{"principal": "rotating", "overlap": "1h"}`, nil)
+	if code != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500", code)
+	}
+
+	apiKeys.RLock()
+	defer apiKeys.RUnlock()
+	if got := apiKeys.Keys[old.Key]; got == nil || !got.ExpiresAt.IsZero() {
+		t.Errorf("old key = %+v, want it kept without expiry", got)
+	}
+	for _, k := range apiKeys.Keys {
+		if k.Principal == "rotating" && k.Key != old.Key {
+			t.Errorf("new key %s kept in memory", k.Key)
+		}
+	}
+	stored, _ := store.LoadAPIKeys(context.Background())
+	if len(stored) != 1 {
+		t.Errorf("%d keys stored, want only the old one", len(stored))
+	}
+}
+
+// TestAdminReadsDuringProxyWrites is meant for go test -race: admin reads of
+// the apps map race proxied requests counting usage and registering apps.
+func TestAdminReadsDuringProxyWrites(t *testing.T) {
+	t.Setenv("AUTO_REGISTER", "true")
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	gw := startGateway(t, appDoc(port))
+	free := closedPort(t)
+
+	// t.Fatal must not be called off the test goroutine, so get and
+	// adminGet are not used here
+	hit := func(path string) {
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				hit(fmt.Sprintf("/%d/", port))
+				// Registers a new app, most likely failing to reach it
+				if other := 40000 + (free+i*25+j)%20000; other != port {
+					hit(fmt.Sprintf("/%d/", other))
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				hit("/admin/usage")
+				hit(fmt.Sprintf("/admin/usage/%d", port))
+			}
+		}()
+	}
+	wg.Wait()
+
+	var status appStatus
+	adminGet(t, gw, fmt.Sprintf("/admin/usage/%d", port), &status)
+	if status.Count != 100 {
+		t.Errorf("count = %d, want 100", status.Count)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// APIKey is a credential kept in the store (the api_keys collection with
+// MongoDB)
+type APIKey struct {
+	Key    string `bson:"key" json:"key"`
+	Secret string `bson:"secret,omitempty" json:"secret,omitempty"`
+	// Principal groups the keys of one caller so that several of them can be
+	// valid at once while rotating
+	Principal string `bson:"principal,omitempty" json:"principal,omitempty"`
+	// Apps lists the app ports the key may access. An empty list, or one
+	// containing 0, allows every app.
+	Apps []int `bson:"apps,omitempty" json:"apps,omitempty"`
+	// ExpiresAt is when the key stops being accepted; zero means never
+	ExpiresAt time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	// Tier is the priority requests made with the key are queued at when an
+	// app is overloaded (see PriorityQueueing)
+	Tier string `bson:"tier,omitempty" json:"tier,omitempty"`
+	// Tenant is who requests made with the key are counted against (see
+	// TenantUsage); empty for the default tenant
+	Tenant string `bson:"tenant,omitempty" json:"tenant,omitempty"`
+}
+
+func (k *APIKey) expired(now time.Time) bool {
+	return !k.ExpiresAt.IsZero() && !now.Before(k.ExpiresAt)
+}
+
+// allows reports whether the key is scoped to the app on port
+func (k *APIKey) allows(port int) bool {
+	if len(k.Apps) == 0 {
+		return true
+	}
+	for _, p := range k.Apps {
+		if p == 0 || p == port {
+			return true
+		}
+	}
+	return false
+}
+
+type apiKeyContextKey struct{}
+
+func withAPIKey(r *http.Request, key *APIKey) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), apiKeyContextKey{}, key))
+}
+
+// apiKeyFromRequest returns the key the request authenticated with, if any
+func apiKeyFromRequest(r *http.Request) (*APIKey, bool) {
+	key, ok := r.Context().Value(apiKeyContextKey{}).(*APIKey)
+	return key, ok
+}
+
+// apiKeyAuth accepts requests carrying a known, unexpired X-Api-Key. Whether
+// the key may access the requested app is checked once the app is resolved.
+type apiKeyAuth struct{}
+
+func (apiKeyAuth) Authenticate(r *http.Request) (Principal, error) {
+	key, ok := apiKeys.get(r.Header.Get("X-Api-Key"))
+	if !ok {
+		return Principal{}, unauthorized("Invalid API key", "")
+	}
+	return Principal{Key: key}, nil
+}
+
+// APIKeyStore is the in-memory copy of the api_keys collection
+type APIKeyStore struct {
+	sync.RWMutex
+	Keys map[string]*APIKey
+}
+
+var apiKeys = APIKeyStore{
+	Keys: make(map[string]*APIKey),
+}
+
+// get returns the key if it exists and has not expired
+func (s *APIKeyStore) get(key string) (*APIKey, bool) {
+	s.RLock()
+	defer s.RUnlock()
+	k, ok := s.Keys[key]
+	if !ok || k.expired(time.Now()) {
+		return nil, false
+	}
+	return k, true
+}
+
+// newAPIKey generates a random key and secret
+func newAPIKey() (*APIKey, error) {
+	b := make([]byte, 48)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return &APIKey{
+		Key:    hex.EncodeToString(b[:16]),
+		Secret: hex.EncodeToString(b[16:]),
+	}, nil
+}
+
+// loadAPIKeys replaces the in-memory keys with the stored ones
+func loadAPIKeys(ctx context.Context, store UsageStore) error {
+	keys, err := store.LoadAPIKeys(ctx)
+	if err != nil {
+		return err
+	}
+	apiKeys.Lock()
+	apiKeys.Keys = keys
+	apiKeys.Unlock()
+	return nil
+}
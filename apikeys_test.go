@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// mintKey mints a key through the admin API from a mintKeyRequest body
+func mintKey(t *testing.T, gw *httptest.Server, body string) *APIKey {
+	t.Helper()
+	var key APIKey
+	if code := adminDo(t, gw, http.MethodPost, "/admin/keys", body, &key); code != http.StatusCreated {
+		t.Fatalf("minting key: status %d", code)
+	}
+	return &key
+}
+
+func getWithKey(t *testing.T, gw *httptest.Server, path, key string) int {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+	if key != "" {
+		req.Header.Set("X-Api-Key", key)
+	}
+	resp, _ := do(t, req)
+	return resp.StatusCode
+}
+
+func TestAPIKeyScopes(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }
+	a, b := startBackend(t, ok), startBackend(t, ok)
+	t.Setenv("API_KEY_AUTH", "true")
+	gw := startGateway(t, appDoc(a), appDoc(b))
+
+	scoped := mintKey(t, gw, fmt.Sprintf(`{"principal": "scoped", "apps": [%d]}`, a))
+	unscoped := mintKey(t, gw, `{"principal": "unscoped"}`)
+	wildcard := mintKey(t, gw, `{"principal": "wildcard", "apps": [0]}`)
+
+	tests := []struct {
+		name string
+		key  string
+		port int
+		want int
+	}{
+		{"scoped key, its app", scoped.Key, a, http.StatusOK},
+		{"scoped key, other app", scoped.Key, b, http.StatusForbidden},
+		{"unscoped key", unscoped.Key, a, http.StatusOK},
+		{"unscoped key, other app", unscoped.Key, b, http.StatusOK},
+		{"wildcard scope", wildcard.Key, b, http.StatusOK},
+		{"no key", "", a, http.StatusUnauthorized},
+		{"unknown key", "nope", a, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := getWithKey(t, gw, fmt.Sprintf("/%d/", tt.port), tt.key); got != tt.want {
+				t.Errorf("status = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
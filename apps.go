@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// prepare derives the app's unexported settings, such as compiled patterns,
+// from the fields decoded from the store
+func (app *App) prepare() {
+	app.responseRewrites = compileRewrites(app.Port, app.ResponseRewrites)
+	app.balancer = newBalancer(app.Port, app.LoadBalancing)
+	if app.UpstreamProxy != "" {
+		proxy, err := parseUpstreamProxy(app.UpstreamProxy)
+		if err != nil {
+			log.Printf("Ignoring upstream proxy for app %d: %v", app.Port, err)
+		} else {
+			app.upstreamProxy = &proxyOverride{proxy}
+		}
+	}
+	if len(app.Auth) > 0 {
+		app.authenticators = compileAuth(app.Port, app.Auth)
+	}
+	if app.RateLimit != nil {
+		app.RateLimit.validate(app.Port)
+	}
+}
+
+// reloadApps re-reads app settings from the store and swaps them in. The
+// in-memory counts are kept since they are ahead of what is stored. App
+// values already in the map are never mutated apart from the counters, so
+// handlers holding an old *App keep a consistent view.
+func reloadApps(store UsageStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	apps, err := store.LoadApps(ctx)
+	if err != nil {
+		log.Printf("Error reloading apps: %v", err)
+		return
+	}
+
+	// apps is not shared until it is published below
+	syncDiscovery(apps)
+	usageData.Lock()
+	for port, app := range apps {
+		if old, ok := usageData.Apps[port]; ok {
+			app.Count = old.Count
+			app.CycleCount, app.CycleStart = old.CycleCount, old.CycleStart
+			app.BytesIn, app.BytesOut = old.BytesIn, old.BytesOut
+		}
+	}
+	usageData.Apps = apps
+	usageData.Unlock()
+	log.Printf("Reloaded %d apps", len(apps))
+	if config.WarmupConns > 0 {
+		go warmUpstreams()
+	}
+}
+
+// watchAppReloads reloads the app settings on SIGHUP and, when interval is
+// positive, periodically.
+func watchAppReloads(store UsageStore, interval time.Duration) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-hup:
+		case <-tick:
+		}
+		reloadApps(store)
+	}
+}
+
+// autoRegister adds an app for a port that has none yet (AUTO_REGISTER), so
+// its default instance on localhost:<port> is proxied to and counted
+func autoRegister(store UsageStore, port int) *App {
+	usageData.Lock()
+	app, ok := usageData.Apps[port]
+	if !ok {
+		app = &App{Port: port}
+		usageData.Apps[port] = app
+	}
+	usageData.Unlock()
+	if ok {
+		return app
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := store.RegisterApp(ctx, port); err != nil {
+		log.Printf("Error registering app %d: %v", port, err)
+	} else {
+		log.Printf("Registered app %d", port)
+	}
+	return app
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+)
+
+// Principal is the caller a request was authenticated as
+type Principal struct {
+	Subject string
+	Scope   string
+	// Key is the API key the caller used, for the key based schemes
+	Key *APIKey
+}
+
+// Authenticator is an authentication scheme. Authenticate returns the caller
+// or, when the credentials are missing or wrong, an error; an *authError
+// carries the status to answer with, anything else is a 401.
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+type authError struct {
+	status int
+	msg    string
+	// challenge is sent as WWW-Authenticate
+	challenge string
+}
+
+func (e *authError) Error() string { return e.msg }
+
+func unauthorized(msg, challenge string) error {
+	return &authError{status: http.StatusUnauthorized, msg: msg, challenge: challenge}
+}
+
+// noAuth lets every request through, for open apps
+type noAuth struct{}
+
+func (noAuth) Authenticate(*http.Request) (Principal, error) { return Principal{}, nil }
+
+// rejectAuth stands in for a misconfigured scheme, so apps fail closed
+type rejectAuth struct{}
+
+func (rejectAuth) Authenticate(*http.Request) (Principal, error) {
+	return Principal{}, &authError{status: http.StatusForbidden, msg: "Authentication misconfigured for this application"}
+}
+
+// newAuthenticator returns the scheme called name in App.Auth
+func newAuthenticator(name string) (Authenticator, bool) {
+	switch name {
+	case "none":
+		return noAuth{}, true
+	case "api_key":
+		return apiKeyAuth{}, true
+	case "hmac":
+		return hmacAuth{config.HMAC}, true
+	case "introspection":
+		if config.Introspection.URL == "" {
+			return nil, false
+		}
+		return introspectionAuth{config.Introspection}, true
+	}
+	return nil, false
+}
+
+func compileAuth(port int, names []string) []Authenticator {
+	var out []Authenticator
+	for _, name := range names {
+		a, ok := newAuthenticator(name)
+		if !ok {
+			log.Printf("Unknown or unconfigured auth scheme %q for app %d; rejecting its requests", name, port)
+			a = rejectAuth{}
+		}
+		out = append(out, a)
+	}
+	return out
+}
+
+// defaultAuth is the schemes enabled globally (INTROSPECTION_URL,
+// API_KEY_AUTH, HMAC_AUTH), for apps without an Auth list and requests not
+// addressed to an app
+func defaultAuth() []Authenticator {
+	var out []Authenticator
+	if config.Introspection.URL != "" {
+		out = append(out, introspectionAuth{config.Introspection})
+	}
+	if config.APIKeyAuth {
+		out = append(out, apiKeyAuth{})
+	}
+	if config.HMAC.Enabled {
+		out = append(out, hmacAuth{config.HMAC})
+	}
+	return out
+}
+
+// authenticate runs the app's authenticators, or the global ones, in order;
+// a request must pass all of them. The principal's key is stored on the
+// request and its subject and scope are forwarded as X-Auth-Subject and
+// X-Auth-Scope.
+func authenticate(global []Authenticator) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// Never let clients supply these themselves
+			r.Header.Del("X-Auth-Scope")
+			r.Header.Del("X-Auth-Subject")
+
+			done := timePhase(r, "auth")
+			schemes := global
+			id, _ := requestAppID(r)
+			if port, err := strconv.Atoi(id); err == nil {
+				usageData.Lock()
+				app := usageData.Apps[port]
+				usageData.Unlock()
+				if app != nil && app.authenticators != nil {
+					schemes = app.authenticators
+				}
+			}
+
+			var p Principal
+			for _, a := range schemes {
+				got, err := a.Authenticate(r)
+				if err != nil {
+					ae, ok := err.(*authError)
+					if !ok {
+						ae = &authError{status: http.StatusUnauthorized, msg: err.Error()}
+					}
+					if ae.challenge != "" {
+						w.Header().Set("WWW-Authenticate", ae.challenge)
+					}
+					done()
+					http.Error(w, ae.msg, ae.status)
+					return
+				}
+				if got.Subject != "" {
+					p.Subject = got.Subject
+				}
+				if got.Scope != "" {
+					p.Scope = got.Scope
+				}
+				if got.Key != nil {
+					p.Key = got.Key
+				}
+			}
+
+			if p.Scope != "" {
+				r.Header.Set("X-Auth-Scope", p.Scope)
+			}
+			if p.Subject != "" {
+				r.Header.Set("X-Auth-Subject", p.Subject)
+			}
+			if p.Key != nil {
+				r = withAPIKey(r, p.Key)
+			}
+			done()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"math"
+	"math/rand"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Balancer chooses the instance of an app's pool a request is sent to
+type Balancer interface {
+	Pick(r *http.Request, instances []*Instance) (*Instance, error)
+}
+
+var errNoInstances = errors.New("no instances available")
+
+// LoadBalancing selects the app's Balancer
+type LoadBalancing struct {
+	// Strategy is "round_robin" (the default), "least_conn", "random" or
+	// "hash"
+	Strategy string `bson:"strategy"`
+	// HashHeader is the request header the hash strategy keys on; without
+	// it, or when the request lacks it, the client IP is used
+	HashHeader string `bson:"hash_header,omitempty"`
+}
+
+func knownStrategy(strategy string) bool {
+	switch strategy {
+	case "", "round_robin", "least_conn", "random", "hash":
+		return true
+	}
+	return false
+}
+
+func newBalancer(port int, lb *LoadBalancing) Balancer {
+	if lb == nil {
+		return roundRobinBalancer{port}
+	}
+	switch lb.Strategy {
+	case "", "round_robin":
+		return roundRobinBalancer{port}
+	case "least_conn":
+		return leastConnBalancer{}
+	case "random":
+		return randomBalancer{}
+	case "hash":
+		return hashBalancer{header: lb.HashHeader}
+	}
+	log.Printf("Unknown load balancing strategy %q for app %d; using round_robin", lb.Strategy, port)
+	return roundRobinBalancer{port}
+}
+
+func totalWeight(instances []*Instance) int {
+	total := 0
+	for _, in := range instances {
+		total += in.weight()
+	}
+	return total
+}
+
+// roundRobin holds the next pool position per app port, so it survives app
+// reloads
+var roundRobin = struct {
+	sync.Mutex
+	next map[int]*uint64
+}{next: make(map[int]*uint64)}
+
+// roundRobinBalancer goes through the pool in weighted round-robin order, so
+// an instance of weight 3 gets three requests for every one sent to an
+// instance of weight 1
+type roundRobinBalancer struct {
+	port int
+}
+
+func (b roundRobinBalancer) Pick(_ *http.Request, instances []*Instance) (*Instance, error) {
+	if len(instances) == 0 {
+		return nil, errNoInstances
+	}
+	if len(instances) == 1 {
+		return instances[0], nil
+	}
+	roundRobin.Lock()
+	n, ok := roundRobin.next[b.port]
+	if !ok {
+		n = new(uint64)
+		roundRobin.next[b.port] = n
+	}
+	roundRobin.Unlock()
+
+	pos := int((atomic.AddUint64(n, 1) - 1) % uint64(totalWeight(instances)))
+	for _, in := range instances {
+		if pos < in.weight() {
+			return in, nil
+		}
+		pos -= in.weight()
+	}
+	return instances[len(instances)-1], nil
+}
+
+// randomBalancer picks an instance at random, in proportion to its weight
+type randomBalancer struct{}
+
+func (randomBalancer) Pick(_ *http.Request, instances []*Instance) (*Instance, error) {
+	if len(instances) == 0 {
+		return nil, errNoInstances
+	}
+	pos := rand.Intn(totalWeight(instances))
+	for _, in := range instances {
+		if pos < in.weight() {
+			return in, nil
+		}
+		pos -= in.weight()
+	}
+	return instances[len(instances)-1], nil
+}
+
+// instanceLoad counts the requests in flight per instance address, for
+// least_conn
+var instanceLoad sync.Map // addr -> *int64
+
+// trackInstance counts a request in flight to addr until the returned func
+// is called
+func trackInstance(addr string) func() {
+	v, _ := instanceLoad.LoadOrStore(addr, new(int64))
+	n := v.(*int64)
+	atomic.AddInt64(n, 1)
+	return func() { atomic.AddInt64(n, -1) }
+}
+
+func inFlightTo(addr string) int64 {
+	if v, ok := instanceLoad.Load(addr); ok {
+		return atomic.LoadInt64(v.(*int64))
+	}
+	return 0
+}
+
+// leastConnBalancer picks the instance with the fewest requests in flight
+// relative to its weight; ties go to the earlier instance
+type leastConnBalancer struct{}
+
+func (leastConnBalancer) Pick(_ *http.Request, instances []*Instance) (*Instance, error) {
+	var best *Instance
+	bestLoad := math.Inf(1)
+	for _, in := range instances {
+		if load := float64(inFlightTo(in.Addr)) / float64(in.weight()); load < bestLoad {
+			best, bestLoad = in, load
+		}
+	}
+	if best == nil {
+		return nil, errNoInstances
+	}
+	return best, nil
+}
+
+// hashBalancer keeps each client on the same instance using weighted
+// rendezvous hashing, so a pool change only moves the clients of the
+// instances that were added or removed
+type hashBalancer struct {
+	header string
+}
+
+func (b hashBalancer) Pick(r *http.Request, instances []*Instance) (*Instance, error) {
+	key := ""
+	if b.header != "" {
+		key = r.Header.Get(b.header)
+	}
+	if key == "" {
+		key = clientIP(r)
+	}
+	var best *Instance
+	bestScore := math.Inf(-1)
+	for _, in := range instances {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(in.Addr))
+		// A uniform value in (0, 1), turned into a score that favors heavier
+		// instances in proportion to their weight
+		u := (float64(mix64(h.Sum64())>>11) + 0.5) / (1 << 53)
+		if score := -float64(in.weight()) / math.Log(u); score > bestScore {
+			best, bestScore = in, score
+		}
+	}
+	if best == nil {
+		return nil, errNoInstances
+	}
+	return best, nil
+}
+
+// mix64 spreads FNV's weakly mixed high bits (the splitmix64 finalizer), as
+// keys that differ only in their last bytes hash close together otherwise
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
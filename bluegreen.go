@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	colorBlue  = "blue"
+	colorGreen = "green"
+)
+
+// BlueGreen gives an app two instance pools, of which only the Active one
+// ("blue" by default) takes traffic. It replaces the app's default and
+// static instances.
+type BlueGreen struct {
+	Blue   []string `bson:"blue"`
+	Green  []string `bson:"green"`
+	Active string   `bson:"active,omitempty"`
+}
+
+func (bg *BlueGreen) active() string {
+	if bg.Active == colorGreen {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+func (bg *BlueGreen) standby() string {
+	if bg.active() == colorBlue {
+		return colorGreen
+	}
+	return colorBlue
+}
+
+// instances returns the active pool
+func (bg *BlueGreen) instances() []*Instance {
+	addrs := bg.Blue
+	if bg.active() == colorGreen {
+		addrs = bg.Green
+	}
+	instances := make([]*Instance, 0, len(addrs))
+	for _, addr := range addrs {
+		instances = append(instances, &Instance{Addr: addr})
+	}
+	return instances
+}
+
+type blueGreenStatus struct {
+	Port    int    `json:"port"`
+	Active  string `json:"active"`
+	Standby string `json:"standby"`
+}
+
+// blueGreenApp returns the app on the request's {port} if it has blue-green
+// pools, writing an error otherwise
+func blueGreenApp(w http.ResponseWriter, r *http.Request) (*App, bool) {
+	port, err := strconv.Atoi(chi.URLParam(r, "port"))
+	if err != nil {
+		http.Error(w, "Invalid application ID", http.StatusBadRequest)
+		return nil, false
+	}
+	usageData.Lock()
+	app := usageData.Apps[port]
+	usageData.Unlock()
+	if app == nil || app.BlueGreen == nil {
+		http.Error(w, "Application has no blue-green pools", http.StatusNotFound)
+		return nil, false
+	}
+	return app, true
+}
+
+// blueGreenHandler reports which pool of the app is active
+// (GET /admin/apps/{port}/blue-green)
+func blueGreenHandler(w http.ResponseWriter, r *http.Request) {
+	app, ok := blueGreenApp(w, r)
+	if !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, blueGreenStatus{app.Port, app.BlueGreen.active(), app.BlueGreen.standby()})
+}
+
+// switchMu serializes switches so concurrent flips can't interleave their
+// store and swap
+var switchMu sync.Mutex
+
+// switchAppHandler makes the app's standby pool active
+// (POST /admin/apps/{port}/switch). The choice is stored first so reloads
+// keep it, then the app is swapped in memory: requests already holding the
+// old App finish against the old pool, new ones go to the new pool.
+func switchAppHandler(store UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switchMu.Lock()
+		defer switchMu.Unlock()
+
+		app, ok := blueGreenApp(w, r)
+		if !ok {
+			return
+		}
+		color := app.BlueGreen.standby()
+
+		ctx, cancel := context.WithTimeout(r.Context(), 20*time.Second)
+		defer cancel()
+		if err := store.SetActivePool(ctx, app.Port, color); err != nil {
+			log.Printf("Error storing active pool for app %d: %v", app.Port, err)
+			http.Error(w, "Error switching pools", http.StatusInternalServerError)
+			return
+		}
+
+		usageData.Lock()
+		// Copy the current value, whose counters may be ahead of app's. A
+		// reload since may have dropped the app or its pools.
+		cur := usageData.Apps[app.Port]
+		if cur == nil || cur.BlueGreen == nil {
+			usageData.Unlock()
+			http.Error(w, "Application has no blue-green pools", http.StatusNotFound)
+			return
+		}
+		next := *cur
+		bg := *next.BlueGreen
+		bg.Active = color
+		next.BlueGreen = &bg
+		usageData.Apps[app.Port] = &next
+		usageData.Unlock()
+
+		log.Printf("Switched app %d to its %s pool", app.Port, color)
+		writeJSON(w, http.StatusOK, blueGreenStatus{app.Port, bg.active(), bg.standby()})
+	}
+}
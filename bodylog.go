@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// BodyLogging logs a sample of the app's request and response bodies, for
+// debugging integrations. Credentials are always masked: the Authorization,
+// Proxy-Authorization, Cookie, Set-Cookie and X-Api-Key headers and
+// "password" fields.
+type BodyLogging struct {
+	// SampleRate logs 1 in N requests (0 = every request)
+	SampleRate int `bson:"sample_rate,omitempty"`
+	// MaxBytes caps how much of each body is logged (0 = 4096)
+	MaxBytes int64 `bson:"max_bytes,omitempty"`
+	// RedactHeaders are further headers to mask
+	RedactHeaders []string `bson:"redact_headers,omitempty"`
+	// RedactFields are further fields to mask in JSON and form bodies,
+	// matched by name at any depth and ignoring case
+	RedactFields []string `bson:"redact_fields,omitempty"`
+}
+
+const redacted = "[REDACTED]"
+
+var (
+	alwaysRedactHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+	alwaysRedactFields  = []string{"password"}
+)
+
+// capturedBody keeps a copy of the first max bytes read through it, so a
+// body can be logged without taking anything from its reader. The copy is
+// locked as the transport may still be reading a request body when the
+// entry is logged.
+type capturedBody struct {
+	io.ReadCloser
+	max int64
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (c *capturedBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.mu.Lock()
+	room := c.max - int64(c.buf.Len())
+	if int64(n) > room {
+		c.truncated = true
+		c.buf.Write(p[:room])
+	} else {
+		c.buf.Write(p[:n])
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *capturedBody) captured() ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte(nil), c.buf.Bytes()...), c.truncated
+}
+
+// bodyLog is a sampled request whose bodies are being captured
+type bodyLog struct {
+	cfg  *BodyLogging
+	port int
+	r    *http.Request
+	req  *capturedBody
+	resp *http.Response
+	body *capturedBody
+}
+
+// startBodyLog samples the request for the app's BodyLogging and, when
+// picked, starts capturing its body; it returns nil otherwise
+func startBodyLog(t proxyTarget, r *http.Request) *bodyLog {
+	if t.app == nil || t.app.BodyLogging == nil {
+		return nil
+	}
+	cfg := t.app.BodyLogging
+	if cfg.SampleRate > 1 && rand.Intn(cfg.SampleRate) != 0 {
+		return nil
+	}
+	bl := &bodyLog{cfg: cfg, port: t.port, r: r}
+	bl.req = &capturedBody{ReadCloser: r.Body, max: cfg.maxBytes()}
+	r.Body = bl.req
+	return bl
+}
+
+func (cfg *BodyLogging) maxBytes() int64 {
+	if cfg.MaxBytes > 0 {
+		return cfg.MaxBytes
+	}
+	return 4096
+}
+
+// response starts capturing the body of the response sent to the client
+func (bl *bodyLog) response(resp *http.Response) {
+	if bl == nil {
+		return
+	}
+	bl.resp = resp
+	bl.body = &capturedBody{ReadCloser: resp.Body, max: bl.cfg.maxBytes()}
+	resp.Body = bl.body
+}
+
+// log writes the captured bodies, redacted, once the request is done
+func (bl *bodyLog) log() {
+	if bl == nil {
+		return
+	}
+	reqBody, truncated := bl.req.captured()
+	line := "request headers=" + bl.headers(bl.r.Header) + " body=" + bl.redactBody(bl.r.Header, reqBody, truncated)
+	if bl.resp != nil {
+		respBody, truncated := bl.body.captured()
+		line += " | response status=" + strconv.Itoa(bl.resp.StatusCode) +
+			" headers=" + bl.headers(bl.resp.Header) + " body=" + bl.redactBody(bl.resp.Header, respBody, truncated)
+	}
+	log.Printf("[%s] Body log for %s %s to app %d: %s",
+		middleware.GetReqID(bl.r.Context()), bl.r.Method, routePath(bl.r), bl.port, line)
+}
+
+func (bl *bodyLog) headers(h http.Header) string {
+	masked := h.Clone()
+	for name := range masked {
+		if containsFold(alwaysRedactHeaders, name) || containsFold(bl.cfg.RedactHeaders, name) {
+			masked[name] = []string{redacted}
+		}
+	}
+	// Maps print with sorted keys
+	return strings.TrimPrefix(fmt.Sprint(map[string][]string(masked)), "map")
+}
+
+// redactBody masks the redacted fields of JSON and form bodies. A truncated
+// JSON body can't be parsed, so it is withheld rather than risk a secret.
+func (bl *bodyLog) redactBody(h http.Header, body []byte, truncated bool) string {
+	if len(body) == 0 {
+		return `""`
+	}
+	suffix := ""
+	if truncated {
+		suffix = " (truncated)"
+	}
+	fields := append(append([]string(nil), alwaysRedactFields...), bl.cfg.RedactFields...)
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	switch {
+	case mt == "application/json" || strings.HasSuffix(mt, "+json"):
+		var v interface{}
+		if truncated || json.Unmarshal(body, &v) != nil {
+			return "[JSON body withheld]" + suffix
+		}
+		out, err := json.Marshal(redactJSON(v, fields))
+		if err != nil {
+			return "[JSON body withheld]"
+		}
+		return string(out)
+	case mt == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "[form body withheld]" + suffix
+		}
+		for name := range values {
+			if containsFold(fields, name) {
+				values[name] = []string{redacted}
+			}
+		}
+		return strconv.Quote(values.Encode()) + suffix
+	}
+	return strconv.Quote(string(body)) + suffix
+}
+
+func redactJSON(v interface{}, fields []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			if containsFold(fields, k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(sub, fields)
+			}
+		}
+	case []interface{}:
+		for i, sub := range v {
+			v[i] = redactJSON(sub, fields)
+		}
+	}
+	return v
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
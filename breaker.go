@@ -0,0 +1,234 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker overrides the global CIRCUIT_* breaker settings for an app;
+// zero fields keep the global value. Setting Failures enables the breaker
+// for the app even when CIRCUIT_FAILURES is off.
+type CircuitBreaker struct {
+	// Failures is the number of server errors that opens the circuit
+	Failures int `bson:"failures,omitempty"`
+	// WindowMS counts the failures of the last that many milliseconds
+	// instead of those in a row
+	WindowMS int64 `bson:"window_ms,omitempty"`
+	// CooldownMS is how long the circuit stays open before it is probed
+	CooldownMS int64 `bson:"cooldown_ms,omitempty"`
+	// HalfOpenProbes is the number of probes let through once the cooldown
+	// has passed, all of which must succeed to close the circuit
+	HalfOpenProbes int `bson:"half_open_probes,omitempty"`
+}
+
+// breakerSettings are an app's effective breaker settings; the breaker is
+// off when failures is 0
+type breakerSettings struct {
+	failures int
+	window   time.Duration
+	cooldown time.Duration
+	probes   int
+}
+
+// circuitSettings resolves the breaker settings of app, which may be nil,
+// over the global defaults
+func circuitSettings(app *App) breakerSettings {
+	s := breakerSettings{
+		failures: config.CircuitFailures,
+		window:   config.CircuitWindow,
+		cooldown: config.CircuitCooldown,
+		probes:   config.CircuitHalfOpenProbes,
+	}
+	if app == nil || app.Circuit == nil {
+		return s
+	}
+	c := app.Circuit
+	if c.Failures > 0 {
+		s.failures = c.Failures
+	}
+	if c.WindowMS > 0 {
+		s.window = time.Duration(c.WindowMS) * time.Millisecond
+	}
+	if c.CooldownMS > 0 {
+		s.cooldown = time.Duration(c.CooldownMS) * time.Millisecond
+	}
+	if c.HalfOpenProbes > 0 {
+		s.probes = c.HalfOpenProbes
+	}
+	return s
+}
+
+// breaker stops sending requests to an app after its threshold of server
+// errors, in a row or within its window. Once the cooldown has passed the
+// configured number of probes is let through: if they all succeed the
+// circuit closes, the first failure opens it again.
+type breaker struct {
+	sync.Mutex
+	port  int
+	state string
+	// failures are the times of the counted failures, oldest first
+	failures []time.Time
+	openedAt time.Time
+	// probes were let through in the half-open state, passed of them
+	// succeeded
+	probes int
+	passed int
+	// opens and rejected count the times the circuit opened and the
+	// requests it turned away
+	opens    int64
+	rejected int64
+}
+
+// breakers holds the breaker per app port, apart from the App values so the
+// state survives app reloads
+var breakers = struct {
+	sync.Mutex
+	m map[int]*breaker
+}{m: make(map[int]*breaker)}
+
+func breakerFor(port int) *breaker {
+	breakers.Lock()
+	defer breakers.Unlock()
+	b, ok := breakers.m[port]
+	if !ok {
+		b = &breaker{port: port, state: circuitClosed}
+		breakers.m[port] = b
+	}
+	return b
+}
+
+// allow reports whether a request may be sent to the app
+func (b *breaker) allow(now time.Time, s breakerSettings) bool {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == circuitOpen {
+		if now.Sub(b.openedAt) < s.cooldown {
+			b.rejected++
+			return false
+		}
+		b.state, b.probes, b.passed = circuitHalfOpen, 0, 0
+		emitEvent(stateEvent{Kind: "circuit", App: b.port, From: circuitOpen, To: circuitHalfOpen})
+	}
+	if b.state == circuitHalfOpen {
+		if b.probes >= s.probes {
+			b.rejected++
+			return false
+		}
+		b.probes++
+	}
+	return true
+}
+
+// record counts the outcome of a request allow let through. failure
+// describes the server error, and is empty for a success.
+func (b *breaker) record(failure string, now time.Time, s breakerSettings) {
+	b.Lock()
+	defer b.Unlock()
+	from := b.state
+	if failure == "" {
+		switch b.state {
+		case circuitHalfOpen:
+			b.passed++
+			if b.passed < s.probes {
+				return
+			}
+		case circuitOpen:
+			// Sent before the circuit opened; only probes may close it
+			return
+		}
+		if s.window <= 0 || from != circuitClosed {
+			b.failures = b.failures[:0]
+		}
+		b.state = circuitClosed
+		if from != circuitClosed {
+			emitEvent(stateEvent{Kind: "circuit", App: b.port, From: from, To: circuitClosed})
+		}
+		return
+	}
+	b.failures = append(b.failures, now)
+	b.prune(now, s)
+	if b.state == circuitHalfOpen || len(b.failures) >= s.failures {
+		if from != circuitOpen {
+			b.opens++
+			emitEvent(stateEvent{Kind: "circuit", App: b.port, From: from, To: circuitOpen, Error: failure})
+		}
+		b.state, b.openedAt = circuitOpen, now
+		b.failures = b.failures[:0]
+	}
+}
+
+// prune drops the failures that no longer count: those outside the window,
+// and beyond the threshold the oldest, as no more are needed to open
+func (b *breaker) prune(now time.Time, s breakerSettings) {
+	drop := 0
+	if s.window > 0 {
+		for drop < len(b.failures) && now.Sub(b.failures[drop]) > s.window {
+			drop++
+		}
+	}
+	if n := len(b.failures) - drop; n > s.failures {
+		drop += n - s.failures
+	}
+	b.failures = append(b.failures[:0], b.failures[drop:]...)
+}
+
+// release gives back what allow took for a request that was not sent
+// upstream after all, so a half-open probe slot is not used up by it
+func (b *breaker) release() {
+	b.Lock()
+	defer b.Unlock()
+	if b.state == circuitHalfOpen && b.probes > 0 {
+		b.probes--
+	}
+}
+
+func (b *breaker) current() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.state
+}
+
+// breakerStatus is a breaker's state and counters with the settings they
+// are judged against, for tuning the thresholds
+type breakerStatus struct {
+	State string `json:"state"`
+	// Failures are the failures currently counted towards Threshold
+	Failures       int        `json:"failures"`
+	Threshold      int        `json:"threshold"`
+	WindowMS       int64      `json:"window_ms,omitempty"`
+	CooldownMS     int64      `json:"cooldown_ms"`
+	HalfOpenProbes int        `json:"half_open_probes"`
+	ProbesPassed   int        `json:"probes_passed,omitempty"`
+	OpenedAt       *time.Time `json:"opened_at,omitempty"`
+	Opens          int64      `json:"opens"`
+	Rejected       int64      `json:"rejected"`
+}
+
+func (b *breaker) status(now time.Time, s breakerSettings) breakerStatus {
+	b.Lock()
+	defer b.Unlock()
+	b.prune(now, s)
+	st := breakerStatus{
+		State:          b.state,
+		Failures:       len(b.failures),
+		Threshold:      s.failures,
+		WindowMS:       s.window.Milliseconds(),
+		CooldownMS:     s.cooldown.Milliseconds(),
+		HalfOpenProbes: s.probes,
+		Opens:          b.opens,
+		Rejected:       b.rejected,
+	}
+	if b.state != circuitClosed {
+		openedAt := b.openedAt
+		st.OpenedAt = &openedAt
+		st.ProbesPassed = b.passed
+	}
+	return st
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBreakerIgnoresCacheHits(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "ok")
+	})
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "cache_ttl_ms": 60000, "circuit": {"failures": 2, "cooldown_ms": 60000}}`, port))
+	path := func(p string) string { return fmt.Sprintf("/%d%s", port, p) }
+
+	for _, step := range []struct {
+		path   string
+		status int
+		cache  string
+	}{
+		{"/ok", http.StatusOK, "MISS"},
+		{"/fail", http.StatusInternalServerError, ""},
+		// Served without the backend, so the failures are still in a row
+		{"/ok", http.StatusOK, "HIT"},
+		{"/fail", http.StatusInternalServerError, ""},
+		{"/ok", http.StatusServiceUnavailable, ""},
+	} {
+		resp, body := get(t, gw, path(step.path))
+		if resp.StatusCode != step.status {
+			t.Fatalf("%s status = %d, want %d: %s", step.path, resp.StatusCode, step.status, body)
+		}
+		if got := resp.Header.Get("X-Cache"); got != step.cache {
+			t.Fatalf("%s X-Cache = %q, want %q", step.path, got, step.cache)
+		}
+	}
+	if state := breakerFor(port).current(); state != circuitOpen {
+		t.Errorf("circuit %s, want open", state)
+	}
+}
+
+func TestBreakerReleaseFreesProbe(t *testing.T) {
+	s := breakerSettings{failures: 1, probes: 1}
+	b := &breaker{state: circuitHalfOpen}
+	if !b.allow(time.Now(), s) {
+		t.Fatal("probe rejected")
+	}
+	b.release()
+	if !b.allow(time.Now(), s) {
+		t.Error("probe slot not given back by release")
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"container/heap"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	inFlightRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_in_flight_requests",
+		Help: "Requests currently being proxied, per app.",
+	}, []string{"app"})
+	bulkheadRejected = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_bulkhead_rejected_total",
+		Help: "Requests rejected because the app's MaxConcurrent limit was reached.",
+	}, []string{"app"})
+	queuedRequests = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "gateway_queued_requests",
+		Help: "Requests waiting for a slot under the app's MaxConcurrent limit, per tier.",
+	}, []string{"app", "tier"})
+	queueTimeouts = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_queue_timeouts_total",
+		Help: "Queued requests that gave up waiting for a slot, per tier.",
+	}, []string{"app", "tier"})
+)
+
+// PriorityQueueing lets requests over an app's MaxConcurrent wait for a slot
+// instead of being rejected straight away. Freed slots go to the waiting
+// request of the highest tier, oldest first.
+type PriorityQueueing struct {
+	// MaxQueue bounds the waiting requests; more are rejected with 503
+	MaxQueue int `bson:"max_queue"`
+	// Header names the request's tier when its API key has none (default
+	// X-Priority). Clients can set it freely, so only rely on it where that
+	// is acceptable.
+	Header string `bson:"header,omitempty"`
+	// Tiers are ordered from highest to lowest priority. Requests naming no
+	// known tier get the last one.
+	Tiers []PriorityTier `bson:"tiers,omitempty"`
+}
+
+// PriorityTier is one priority level and how long its requests may wait
+type PriorityTier struct {
+	Name string `bson:"name"`
+	// TimeoutMS is how long a request waits before getting 503 (0 = until
+	// the client gives up)
+	TimeoutMS int64 `bson:"timeout_ms,omitempty"`
+}
+
+// classify returns the rank (0 is highest), tier name and wait timeout for r
+func (q *PriorityQueueing) classify(r *http.Request) (rank int, name string, wait time.Duration) {
+	if len(q.Tiers) == 0 {
+		return 0, "", 0
+	}
+	if key, ok := apiKeyFromRequest(r); ok && key.Tier != "" {
+		name = key.Tier
+	} else {
+		header := q.Header
+		if header == "" {
+			header = "X-Priority"
+		}
+		name = r.Header.Get(header)
+	}
+	rank = len(q.Tiers) - 1
+	for i, t := range q.Tiers {
+		if t.Name == name {
+			rank = i
+			break
+		}
+	}
+	t := q.Tiers[rank]
+	return rank, t.Name, time.Duration(t.TimeoutMS) * time.Millisecond
+}
+
+// bulkhead tracks the requests in flight to one app and those queued for a
+// slot. It is kept apart from the App values so the state survives app
+// reloads.
+type bulkhead struct {
+	sync.Mutex
+	inFlight int
+	limit    int
+	waiting  waitQueue
+	seq      uint64
+}
+
+type waiter struct {
+	rank  int
+	seq   uint64
+	ready chan struct{}
+	// index is the waiter's position in the queue, -1 once it was handed a slot
+	index int
+}
+
+// waitQueue is a heap of waiters ordered by rank, then arrival
+type waitQueue []*waiter
+
+func (q waitQueue) Len() int { return len(q) }
+func (q waitQueue) Less(i, j int) bool {
+	if q[i].rank != q[j].rank {
+		return q[i].rank < q[j].rank
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waitQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+func (q *waitQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waitQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	w.index = -1
+	return w
+}
+
+var bulkheads = struct {
+	sync.Mutex
+	m map[int]*bulkhead
+}{m: make(map[int]*bulkhead)}
+
+func bulkheadFor(port int) *bulkhead {
+	bulkheads.Lock()
+	defer bulkheads.Unlock()
+	b, ok := bulkheads.m[port]
+	if !ok {
+		b = &bulkhead{}
+		bulkheads.m[port] = b
+	}
+	return b
+}
+
+// acquireSlot admits a request to the app on port unless limit (> 0)
+// requests are already in flight, so one slow backend can only tie up its own
+// share of the gateway. With queue set, the request waits for a slot
+// according to its tier instead of failing immediately. The returned release
+// must be called when the request is done.
+func acquireSlot(r *http.Request, port, limit int, queue *PriorityQueueing) (release func(), ok bool) {
+	b := bulkheadFor(port)
+	label := strconv.Itoa(port)
+
+	b.Lock()
+	b.limit = limit
+	if limit <= 0 || b.inFlight < limit {
+		b.inFlight++
+		b.Unlock()
+		return b.admitted(label), true
+	}
+	if queue == nil || len(b.waiting) >= queue.MaxQueue {
+		b.Unlock()
+		bulkheadRejected.WithLabelValues(label).Inc()
+		return nil, false
+	}
+	rank, tier, wait := queue.classify(r)
+	w := &waiter{rank: rank, seq: b.seq, ready: make(chan struct{})}
+	b.seq++
+	heap.Push(&b.waiting, w)
+	b.Unlock()
+
+	queued := queuedRequests.WithLabelValues(label, tier)
+	queued.Inc()
+	defer queued.Dec()
+
+	var expired <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-w.ready:
+		return b.admitted(label), true
+	case <-expired:
+	case <-r.Context().Done():
+	}
+
+	b.Lock()
+	if w.index < 0 {
+		// Handed a slot just as the wait ended
+		b.Unlock()
+		return b.admitted(label), true
+	}
+	heap.Remove(&b.waiting, w.index)
+	b.Unlock()
+	queueTimeouts.WithLabelValues(label, tier).Inc()
+	return nil, false
+}
+
+// admitted counts a request that holds a slot and returns its release
+func (b *bulkhead) admitted(label string) func() {
+	gauge := inFlightRequests.WithLabelValues(label)
+	gauge.Inc()
+	return func() {
+		gauge.Dec()
+		b.release()
+	}
+}
+
+// release frees a slot, handing it to the most important waiter if any
+func (b *bulkhead) release() {
+	b.Lock()
+	defer b.Unlock()
+	b.inFlight--
+	for len(b.waiting) > 0 && (b.limit <= 0 || b.inFlight < b.limit) {
+		w := heap.Pop(&b.waiting).(*waiter)
+		b.inFlight++
+		close(w.ready)
+	}
+}
+
+// load returns the requests holding a slot and those queued for one
+func (b *bulkhead) load() (inFlight, queued int) {
+	b.Lock()
+	defer b.Unlock()
+	return b.inFlight, len(b.waiting)
+}
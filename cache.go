@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// cacheEntry is a stored upstream 200 response
+type cacheEntry struct {
+	key      string // resource key extended with the Vary'd header values
+	resource string
+	vary     []string
+
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+// responseCache is a size-bounded LRU of upstream responses for apps with
+// caching enabled (CacheTTLMS).
+//
+// A resource may have several representations selected by request headers,
+// as listed in the upstream's Vary header. varies remembers those header
+// names per resource, and each representation is stored under the resource
+// key extended with the request's values for them, so e.g. a gzip body is
+// never served to a client that did not send Accept-Encoding: gzip.
+type responseCache struct {
+	sync.Mutex
+	max     int
+	lru     *list.List
+	entries map[string]*list.Element
+	varies  map[string][]string
+}
+
+var responses = &responseCache{
+	lru:     list.New(),
+	entries: make(map[string]*list.Element),
+	varies:  make(map[string][]string),
+}
+
+// varyKey extends the resource key with the request's values of the headers
+// the representation varies on
+func varyKey(key string, vary []string, h http.Header) string {
+	var b strings.Builder
+	b.WriteString(key)
+	for _, name := range vary {
+		b.WriteString("\x00")
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(strings.Join(h.Values(name), ","))
+	}
+	return b.String()
+}
+
+// parseVary returns the canonical header names of a Vary header, and false
+// for "Vary: *", which makes a response uncacheable
+func parseVary(h http.Header) ([]string, bool) {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "*" {
+				return nil, false
+			}
+			if name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+// matches reports whether the entry is the representation r asks for
+func (e *cacheEntry) matches(r *http.Request) bool {
+	return e.key == varyKey(e.resource, e.vary, r.Header)
+}
+
+// cacheFlight collapses concurrent misses for the same resource into one
+// upstream request
+var cacheFlight singleflight.Group
+
+// coalesce runs fetch for the first of several concurrent misses on key and
+// hands its cached entry to all of them. led reports whether this caller ran
+// fetch. Waiters get nil when the response could not be cached, and must then
+// fetch for themselves; they must also check the entry matches their own
+// Vary'd headers.
+func coalesce(key string, fetch func() *cacheEntry) (e *cacheEntry, led bool) {
+	v, _, _ := cacheFlight.Do(key, func() (interface{}, error) {
+		led = true
+		return fetch(), nil
+	})
+	e, _ = v.(*cacheEntry)
+	return e, led
+}
+
+// lookup finds the representation of the resource matching r's headers
+func (c *responseCache) lookup(key string, r *http.Request) (*cacheEntry, bool) {
+	c.Lock()
+	vary := c.varies[key]
+	c.Unlock()
+	return c.get(varyKey(key, vary, r.Header))
+}
+
+func (c *responseCache) get(key string) (*cacheEntry, bool) {
+	c.Lock()
+	defer c.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e, true
+}
+
+func (c *responseCache) put(e *cacheEntry) {
+	c.Lock()
+	defer c.Unlock()
+	if el, ok := c.entries[e.key]; ok {
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.varies[e.resource] = e.vary
+	for c.max > 0 && c.lru.Len() > c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		evicted := oldest.Value.(*cacheEntry)
+		delete(c.entries, evicted.key)
+		// Other representations of the resource become unreachable too and
+		// age out; the next miss stores the Vary list again
+		delete(c.varies, evicted.resource)
+	}
+}
+
+// cacheKey returns the resource key r is cached under, and false when r must not be
+// served from or stored in the cache. Only GETs without credentials to apps
+// with caching enabled are cached. Apps running an A/B experiment are not,
+// as each variant answers differently.
+func cacheKey(t proxyTarget, r *http.Request) (string, bool) {
+	if t.app == nil || t.app.CacheTTLMS <= 0 || r.Method != http.MethodGet || t.app.Experiment != nil {
+		return "", false
+	}
+	if hasCredentials(r) {
+		return "", false
+	}
+	// Range requests go upstream so the client gets its 206, not the whole
+	// cached body
+	if r.Header.Get("Range") != "" {
+		return "", false
+	}
+	if strings.Contains(r.Header.Get("Cache-Control"), "no-cache") {
+		return "", false
+	}
+	// Backends doing virtual hosting answer differently per Host
+	return strconv.Itoa(t.port) + " " + forwardedHost(t, r) + " " + routePath(r) + "?" + r.URL.RawQuery, true
+}
+
+// credentialHeaders identify the caller, so a response to a request carrying
+// any of them may be meant for that caller alone. TENANT_HEADER counts too.
+var credentialHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-Api-Key", "X-Signature"}
+
+func hasCredentials(r *http.Request) bool {
+	for _, name := range credentialHeaders {
+		if r.Header.Get(name) != "" {
+			return true
+		}
+	}
+	return config.TenantHeader != "" && r.Header.Get(config.TenantHeader) != ""
+}
+
+// cacheTTL is how long resp may be stored for, 0 when it must not be
+func cacheTTL(app *App, resp *http.Response) time.Duration {
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Set-Cookie") != "" {
+		return 0
+	}
+	ttl := time.Duration(app.CacheTTLMS) * time.Millisecond
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(strings.ToLower(directive)), "=")
+		switch name {
+		case "no-store", "no-cache", "private":
+			return 0
+		case "max-age", "s-maxage":
+			if secs, err := strconv.Atoi(value); err == nil && time.Duration(secs)*time.Second < ttl {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return ttl
+}
+
+// storeResponse buffers resp into the cache if it is cacheable and no larger
+// than CACHE_MAX_BODY. When it returns false resp.Body is still complete and
+// must be relayed as usual.
+func storeResponse(key string, app *App, r *http.Request, resp *http.Response) (*cacheEntry, bool) {
+	ttl := cacheTTL(app, resp)
+	if ttl <= 0 || resp.ContentLength > config.CacheMaxBody {
+		return nil, false
+	}
+	vary, ok := parseVary(resp.Header)
+	if !ok {
+		return nil, false
+	}
+	orig := resp.Body
+	body, err := io.ReadAll(io.LimitReader(orig, config.CacheMaxBody+1))
+	if err != nil || int64(len(body)) > config.CacheMaxBody {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), orig), orig}
+		return nil, false
+	}
+
+	header := resp.Header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	e := &cacheEntry{
+		key:      varyKey(key, vary, r.Header),
+		resource: key,
+		vary:     vary,
+		header:   header,
+		body:     body,
+		expires:  time.Now().Add(ttl),
+	}
+	responses.put(e)
+	return e, true
+}
+
+// conditionalHeaders are held back from the upstream on a cache miss so the
+// backend returns a full, cacheable response; the gateway then answers the
+// condition itself from the stored entry
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since"}
+
+func stripConditionals(h http.Header) http.Header {
+	saved := make(http.Header)
+	for _, name := range conditionalHeaders {
+		if v, ok := h[name]; ok {
+			saved[name] = v
+			h.Del(name)
+		}
+	}
+	return saved
+}
+
+func restoreConditionals(h, saved http.Header) {
+	for name, v := range saved {
+		h[name] = v
+	}
+}
+
+// notModified evaluates the request's conditional headers against a stored
+// entry. If-None-Match takes precedence over If-Modified-Since (RFC 9110
+// section 13.2.2).
+func notModified(r *http.Request, e *cacheEntry) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		etag := strings.TrimPrefix(e.header.Get("ETag"), "W/")
+		if etag == "" {
+			return false
+		}
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+		return false
+	}
+	ims, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(e.header.Get("Last-Modified"))
+	return err == nil && !lm.After(ims)
+}
+
+// notModifiedHeaders are the headers a 304 carries over from the full
+// response (RFC 9110 section 15.4.5)
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Last-Modified", "Vary"}
+
+// serveCached answers r from the cache entry, with a bodyless 304 when the
+// client's copy is still current
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry, status string) {
+	w.Header().Set("X-Cache", status)
+	writeServerTiming(w, r)
+	if notModified(r, e) {
+		for _, name := range notModifiedHeaders {
+			if v, ok := e.header[name]; ok {
+				w.Header()[name] = v
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	for key, values := range e.header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
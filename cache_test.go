@@ -0,0 +1,24 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestCacheKeySkipsCredentials(t *testing.T) {
+	config.TenantHeader = "X-Tenant"
+	t.Cleanup(func() { config.TenantHeader = "" })
+	target := proxyTarget{port: 8080, app: &App{CacheTTLMS: 1000}}
+
+	for _, header := range []string{"Authorization", "Cookie", "X-Api-Key", "X-Signature", "X-Tenant"} {
+		r, _ := http.NewRequest(http.MethodGet, "/8080/items", nil)
+		r.Header.Set(header, "secret")
+		if _, ok := cacheKey(target, r); ok {
+			t.Errorf("request with %s is cached", header)
+		}
+	}
+	r, _ := http.NewRequest(http.MethodGet, "/8080/items", nil)
+	if _, ok := cacheKey(target, r); !ok {
+		t.Error("anonymous request is not cached")
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP returns the address of the client that sent r. X-Forwarded-For is
+// only believed as far as it was appended by TRUSTED_PROXIES: the chain is
+// walked from the right, skipping trusted hops, and the first untrusted
+// address is the client. Anything a client wrote further left is ignored.
+func clientIP(r *http.Request) string {
+	peer, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		peer = r.RemoteAddr
+	}
+	if !trustedProxy(peer) {
+		return peer
+	}
+
+	var hops []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(hops[i])
+		if ip == nil {
+			// Garbage from a client; what lies to its left can't be trusted
+			return peer
+		}
+		if !trustedProxy(hops[i]) {
+			return ip.String()
+		}
+		peer = ip.String()
+	}
+	return peer
+}
+
+func trustedProxy(addr string) bool {
+	return inNets(addr, config.TrustedProxies)
+}
+
+// inNets reports whether addr is an IP within one of nets
+func inNets(addr string, nets []*net.IPNet) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
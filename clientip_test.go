@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestClientIPIgnoresSpoofedForwardedFor(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	config.TrustedProxies = loadConfig().TrustedProxies
+	t.Cleanup(func() { config.TrustedProxies = nil })
+
+	tests := []struct {
+		name   string
+		peer   string
+		xff    []string
+		client string
+	}{
+		{"untrusted peer", "203.0.113.9:5000", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"trusted proxy", "10.0.0.2:5000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"spoofed left of the proxy's entry", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"chain of trusted proxies", "10.0.0.2:5000", []string{"1.2.3.4, 198.51.100.1, 10.0.0.7"}, "198.51.100.1"},
+		{"spoofed in a separate header", "10.0.0.2:5000", []string{"1.2.3.4", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage hop", "10.0.0.2:5000", []string{"1.2.3.4, not-an-ip"}, "10.0.0.2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.peer
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if got := clientIP(r); got != tt.client {
+				t.Errorf("clientIP = %q, want %q", got, tt.client)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"compress/gzip"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compress gzips proxied responses for clients that accept it. Only bodies
+// of at least COMPRESSION_MIN_SIZE bytes whose Content-Type is in
+// COMPRESSION_TYPES are compressed, at COMPRESSION_LEVEL; responses a
+// backend already encoded pass through. The first bytes are held back until
+// the threshold is reached or the handler flushes or returns.
+func compress(level, minSize int, types []string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cw := &compressWriter{
+				ResponseWriter: w,
+				accepts:        acceptsGzip(r.Header.Get("Accept-Encoding")),
+				head:           r.Method == http.MethodHead,
+				level:          level,
+				minSize:        minSize,
+				types:          types,
+			}
+			defer cw.close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// acceptsGzip reports whether an Accept-Encoding allows gzip
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	accepts, head bool
+	level         int
+	minSize       int
+	types         []string
+
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.status != 0 || cw.decided {
+		return
+	}
+	cw.status = status
+	// Nothing to compress, so there is no reason to hold the header back
+	if cw.head || status < 200 || status == http.StatusNoContent || status == http.StatusNotModified {
+		cw.decide(false)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if cw.decided {
+		if cw.gz != nil {
+			return cw.gz.Write(p)
+		}
+		return cw.ResponseWriter.Write(p)
+	}
+	cw.buf = append(cw.buf, p...)
+	if len(cw.buf) >= cw.minSize {
+		cw.decide(true)
+	}
+	return len(p), nil
+}
+
+// Flush commits to compressing, or not, before the threshold is reached,
+// going by the Content-Length if the backend sent one
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		big := len(cw.buf) >= cw.minSize
+		if n, err := strconv.Atoi(cw.Header().Get("Content-Length")); err != nil || n >= cw.minSize {
+			big = true
+		}
+		cw.decide(big)
+	}
+	if cw.gz != nil {
+		cw.gz.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if !cw.decided {
+		cw.decide(len(cw.buf) >= cw.minSize)
+	}
+	if cw.gz != nil {
+		cw.gz.Close()
+	}
+}
+
+// decide sends the header, compressing the body when it is big enough and
+// its type and the client allow it, then writes what was held back
+func (cw *compressWriter) decide(big bool) {
+	cw.decided = true
+	h := cw.Header()
+	status := cw.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	eligible := status != http.StatusPartialContent && h.Get("Content-Encoding") == "" && cw.compressible(h.Get("Content-Type"))
+	if eligible {
+		// Caches must keep the encodings apart, whether this one was
+		// compressed or not
+		h.Add("Vary", "Accept-Encoding")
+	}
+	if eligible && big && cw.accepts && !cw.head {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", "gzip")
+		cw.gz, _ = gzip.NewWriterLevel(cw.ResponseWriter, cw.level)
+	}
+	cw.ResponseWriter.WriteHeader(status)
+	if len(cw.buf) > 0 {
+		if cw.gz != nil {
+			cw.gz.Write(cw.buf)
+		} else {
+			cw.ResponseWriter.Write(cw.buf)
+		}
+		cw.buf = nil
+	}
+}
+
+func (cw *compressWriter) compressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range cw.types {
+		if matchMediaType(pattern, mt) {
+			return true
+		}
+	}
+	return false
+}
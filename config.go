@@ -0,0 +1,615 @@
+package main
+
+import (
+	"compress/gzip"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Config holds the gateway-wide settings read from the environment
+type Config struct {
+	// UpstreamTimeout bounds a single proxied request (UPSTREAM_TIMEOUT, 0 = no limit)
+	UpstreamTimeout time.Duration
+	// MaxBodySize caps the request body forwarded upstream in bytes (MAX_BODY_SIZE, 0 = no limit)
+	MaxBodySize int64
+	// UpstreamRetries is how many times a failed idempotent request is retried
+	// (UPSTREAM_RETRIES); requests with a body only when it fits RETRY_MAX_BODY
+	UpstreamRetries int
+	// RetryMaxBody is the largest request body buffered so it can be sent
+	// again on retry (RETRY_MAX_BODY); requests with larger bodies are only
+	// attempted once
+	RetryMaxBody int64
+	// RetryBackoff is the delay before the first retry, doubling after each
+	// attempt (RETRY_BACKOFF). A 503's Retry-After takes precedence.
+	RetryBackoff time.Duration
+	// RetryMaxDelay is the longest wait before a retry (RETRY_MAX_DELAY, 0 =
+	// the app's upstream timeout). Backoffs are capped at it; a Retry-After
+	// asking for longer is not waited for and the 503 is returned as is.
+	RetryMaxDelay time.Duration
+	// RequestBudget bounds the total time spent on a request across all
+	// attempts and backoffs (REQUEST_BUDGET, 0 = no limit)
+	RequestBudget time.Duration
+	// TimeoutRetryAfter is the Retry-After sent with the gateway's 504s
+	// (TIMEOUT_RETRY_AFTER, 0 = none)
+	TimeoutRetryAfter time.Duration
+	// LatencyBuckets are the upstream latency histogram buckets in seconds
+	// (UPSTREAM_LATENCY_BUCKETS, comma separated); LatencyLastByte
+	// (UPSTREAM_LATENCY_LAST_BYTE) also tracks the time to last byte
+	LatencyBuckets  []float64
+	LatencyLastByte bool
+	// RouteBy is where the app ID of a request is read from (ROUTE_BY):
+	// "path", its first segment, or "header", the RouteHeader header
+	// (ROUTE_HEADER), in which case the whole path is forwarded
+	RouteBy     string
+	RouteHeader string
+	// PrefixRoutes send path-routed requests whose first segment is not an
+	// app ID to the app of the first matching rule (PREFIX_ROUTES, comma
+	// separated pattern=port, e.g. "/api/v1/*=8081,/api/*=8080"); see
+	// requestAppID for the precedence
+	PrefixRoutes []PrefixRoute
+	// DefaultBackend (DEFAULT_BACKEND, host:port) receives requests for "/",
+	// non-numeric app IDs and unregistered apps that no prefix route
+	// matches; without it they get 404
+	DefaultBackend string
+	// BasePath (BASE_PATH, e.g. "/gateway") mounts every route of the main
+	// listener under a prefix, for a gateway served from a sub-path of
+	// another proxy. It is stripped before the app is resolved.
+	BasePath string
+	// AutoRegister registers unknown numeric app IDs on first use instead of
+	// answering 404 (AUTO_REGISTER)
+	AutoRegister bool
+	// RequestTimeout bounds the whole handling of a proxied request,
+	// answering 503 if nothing was sent by then (REQUEST_TIMEOUT, 0 = no
+	// limit). It backs up UpstreamTimeout and RequestBudget, so it should be
+	// the longest of the three.
+	RequestTimeout time.Duration
+	// CircuitFailures opens an app's circuit after that many server errors
+	// in a row (CIRCUIT_FAILURES, 0 = disabled), or within CircuitWindow
+	// when set (CIRCUIT_WINDOW); it is probed again after CircuitCooldown
+	// (CIRCUIT_COOLDOWN) with CircuitHalfOpenProbes requests
+	// (CIRCUIT_HALF_OPEN_PROBES). Apps can override each, see CircuitBreaker.
+	CircuitFailures       int
+	CircuitWindow         time.Duration
+	CircuitCooldown       time.Duration
+	CircuitHalfOpenProbes int
+	// EventsWebhookURL receives circuit breaker and health state changes
+	// as JSON POSTs (EVENTS_WEBHOOK_URL), e.g. to page on-call
+	EventsWebhookURL string
+	// DNSCacheTTL caches upstream host lookups (DNS_CACHE_TTL, 0 = disabled)
+	DNSCacheTTL time.Duration
+	// ShutdownTimeout is how long in-flight requests get to finish on
+	// SIGINT/SIGTERM before their connections are closed (SHUTDOWN_TIMEOUT)
+	ShutdownTimeout time.Duration
+	// PIDFile is written with the process ID at startup and removed on
+	// shutdown (PID_FILE)
+	PIDFile string
+	// ExtraMethods are custom request methods forwarded on top of the
+	// standard and WebDAV ones (EXTRA_METHODS, comma separated). They are
+	// never retried.
+	ExtraMethods []string
+	// StripSlashes drops trailing slashes while normalizing paths (STRIP_SLASHES)
+	StripSlashes bool
+	// DisabledMiddlewares are pipeline stages left out (DISABLE_MIDDLEWARES,
+	// comma separated names, see pipeline.go)
+	DisabledMiddlewares []string
+	// AppsReloadInterval re-reads app settings from MongoDB periodically
+	// (APPS_RELOAD_INTERVAL, 0 = only on SIGHUP)
+	AppsReloadInterval time.Duration
+	// AppLoadWorkers is how many goroutines decode app documents while
+	// loading them (APP_LOAD_WORKERS, default the number of CPUs)
+	AppLoadWorkers int
+
+	// Storage is where apps and usage are kept (STORAGE): "mongo", or
+	// "memory" to run without MongoDB, with apps read from AppsFile
+	// (APPS_FILE, a mongoexport dump of the apps collection)
+	Storage  string
+	AppsFile string
+	// StoreHealthInterval is how often the store is checked, and counters
+	// kept during an outage are flushed (STORE_HEALTH_INTERVAL)
+	StoreHealthInterval time.Duration
+
+	// TrustedProxies are the peers whose X-Forwarded-For entries are
+	// believed when working out the client IP (TRUSTED_PROXIES, comma
+	// separated CIDRs or addresses)
+	TrustedProxies []*net.IPNet
+
+	// APIKeysCollection holds the API keys and their secrets (APIKEYS_COLLECTION)
+	APIKeysCollection string
+	// UsageCollection holds the usage per tenant (USAGE_COLLECTION)
+	UsageCollection string
+	// TenantHeader names the request header a tenant is read from when the
+	// request's API key has none (TENANT_HEADER, off when empty). Only the
+	// tenants of TenantAllowlist (TENANT_ALLOWLIST, comma separated) are
+	// taken from it, as anyone can send the header.
+	TenantHeader    string
+	TenantAllowlist []string
+	// UsageFlushInterval is how often the apps' usage counted since the last
+	// flush is added to the store (USAGE_FLUSH_INTERVAL), in batches of
+	// UsageFlushBatchSize apps (USAGE_FLUSH_BATCH_SIZE), up to
+	// UsageFlushConcurrency (USAGE_FLUSH_CONCURRENCY) of them at once
+	UsageFlushInterval    time.Duration
+	UsageFlushBatchSize   int
+	UsageFlushConcurrency int
+	// TenantFlushInterval is how often the tenant usage counted since the
+	// last flush is written to the store (TENANT_FLUSH_INTERVAL)
+	TenantFlushInterval time.Duration
+	// UsageHistory also keeps usage per app, tenant and hour, in
+	// UsageHistoryCollection (USAGE_HISTORY, USAGE_HISTORY_COLLECTION), so
+	// rollups can cover a time range. Each flush writes its buckets in
+	// batches of UsageHistoryBatchSize (USAGE_HISTORY_BATCH_SIZE), up to
+	// UsageHistoryFlushConcurrency (USAGE_HISTORY_FLUSH_CONCURRENCY) of
+	// them at once.
+	UsageHistory                 bool
+	UsageHistoryCollection       string
+	UsageHistoryBatchSize        int
+	UsageHistoryFlushConcurrency int
+	// APIKeyAuth requires a known X-Api-Key on proxied requests (API_KEY_AUTH)
+	APIKeyAuth bool
+
+	// MaxConnections caps open client connections on the proxy listener
+	// (MAX_CONNECTIONS, 0 = no limit)
+	MaxConnections int
+	// IdleTimeout closes idle keep-alive client connections (IDLE_TIMEOUT)
+	IdleTimeout time.Duration
+
+	// ThrottleLimit caps the proxied requests handled at once across all
+	// apps (THROTTLE_LIMIT, 0 = no limit). Up to ThrottleBacklog
+	// (THROTTLE_BACKLOG) more wait for ThrottleBacklogTimeout
+	// (THROTTLE_BACKLOG_TIMEOUT) before getting 503.
+	ThrottleLimit          int
+	ThrottleBacklog        int
+	ThrottleBacklogTimeout time.Duration
+	// MaxRequestsPerIP caps the proxied requests in flight from one client
+	// IP, answering 429 beyond it (MAX_REQUESTS_PER_IP, 0 = no limit).
+	// IPAllowlist (IP_LIMIT_ALLOWLIST, comma separated CIDRs or addresses)
+	// are exempt.
+	MaxRequestsPerIP int
+	IPAllowlist      []*net.IPNet
+
+	// WarmupConns opens that many connections to each backend at startup
+	// and for backends added by a reload (WARMUP_CONNS, 0 = off), with HEAD
+	// requests for WarmupPath (WARMUP_PATH). Unreachable backends are
+	// retried every WarmupRetryInterval (WARMUP_RETRY_INTERVAL).
+	WarmupConns         int
+	WarmupPath          string
+	WarmupRetryInterval time.Duration
+
+	// KubernetesDiscovery lets apps discover their instances from Kubernetes
+	// EndpointSlices (K8S_DISCOVERY)
+	KubernetesDiscovery bool
+	// ConsulAddr is the Consul HTTP API apps discover instances from
+	// (CONSUL_ADDR), ConsulToken its ACL token (CONSUL_TOKEN)
+	ConsulAddr  string
+	ConsulToken string
+
+	// ResponseBufferSize coalesces small upstream chunks into writes of up
+	// to this many bytes (RESPONSE_BUFFER_SIZE, 0 = stream every chunk),
+	// flushed at least every ResponseFlushInterval (RESPONSE_FLUSH_INTERVAL)
+	ResponseBufferSize    int
+	ResponseFlushInterval time.Duration
+
+	// RewriteMaxBody is the largest body response rewrites and request field
+	// injection are applied to (REWRITE_MAX_BODY); larger bodies pass through
+	// unchanged
+	RewriteMaxBody int64
+
+	// CacheMaxEntries bounds the response cache (CACHE_MAX_ENTRIES) and
+	// CacheMaxBody the size of a single cached body (CACHE_MAX_BODY)
+	CacheMaxEntries int
+	CacheMaxBody    int64
+
+	// LogSampleRate logs 1 in N successful requests (LOG_SAMPLE_RATE);
+	// requests slower than LogSlowThreshold (LOG_SLOW_THRESHOLD) and errors
+	// are always logged
+	LogSampleRate    int
+	LogSlowThreshold time.Duration
+
+	// LogFile writes logs to a rotated file instead of stderr (LOG_FILE).
+	// Files rotate at LogMaxSizeMB (LOG_MAX_SIZE) and every
+	// LogRotateInterval (LOG_ROTATE_INTERVAL, 0 = size only); LogMaxBackups
+	// (LOG_MAX_BACKUPS) and LogMaxAgeDays (LOG_MAX_AGE) bound the old files
+	// kept, 0 meaning no limit, and LogCompress (LOG_COMPRESS) gzips them.
+	LogFile           string
+	LogMaxSizeMB      int
+	LogRotateInterval time.Duration
+	LogMaxBackups     int
+	LogMaxAgeDays     int
+	LogCompress       bool
+
+	// OTLPEndpoint is the OpenTelemetry collector access logs are exported
+	// to over OTLP/HTTP (OTLP_ENDPOINT, empty = disabled), as service
+	// OTLPServiceName (OTEL_SERVICE_NAME). OTLPLogsOnly (OTLP_LOGS_ONLY)
+	// stops writing them to the regular log.
+	OTLPEndpoint    string
+	OTLPServiceName string
+	OTLPLogsOnly    bool
+
+	// GeoIPDB is the MaxMind GeoLite2 database used for geo routing (GEOIP_DB)
+	GeoIPDB string
+
+	// ErrorPagesDir holds the custom error pages apps can opt into (ERROR_PAGES_DIR)
+	ErrorPagesDir string
+
+	// QuotaCycleDay is the day of month (1-28, UTC) app quotas reset on (QUOTA_CYCLE_DAY)
+	QuotaCycleDay int
+	// QuotaStatus is returned once an app's quota is used up (QUOTA_STATUS, 429 or 402)
+	QuotaStatus int
+
+	// AppPort is the port the gateway listens on (APP_PORT)
+	AppPort string
+	// ViaToken names the gateway in the Via headers it adds and checks for
+	// loops (VIA_TOKEN, default hostname:APP_PORT). Gateways forwarding to
+	// each other need distinct tokens.
+	ViaToken string
+	// AdminPort serves the admin API on a separate listener (ADMIN_PORT);
+	// when empty it is mounted under /admin on the main listener
+	AdminPort string
+	// AdminToken is the bearer token the admin API requires (ADMIN_TOKEN)
+	AdminToken string
+	// UpstreamOverride lets requests carrying the admin token pick their
+	// upstream with X-Gateway-Upstream (UPSTREAM_OVERRIDE); see
+	// upstreamOverride
+	UpstreamOverride bool
+	// Compression gzips proxied responses (COMPRESSION) at CompressionLevel
+	// (COMPRESSION_LEVEL, 1-9), when they are at least CompressionMinSize
+	// bytes (COMPRESSION_MIN_SIZE) and of one of CompressionTypes
+	// (COMPRESSION_TYPES, comma separated, "type/*" allowed)
+	Compression        bool
+	CompressionLevel   int
+	CompressionMinSize int
+	CompressionTypes   []string
+	// LimitBypassPaths are path patterns (LIMIT_BYPASS_PATHS, comma
+	// separated, a trailing "*" for a prefix), matched against the routing
+	// path, e.g. "/8080/health", whose requests skip the rate limits and the
+	// ip_limit and throttle stages, so probes are never turned away. They
+	// are still authenticated. Default none.
+	LimitBypassPaths []string
+	// ServerTiming adds a Server-Timing header with the time spent on auth,
+	// rate limiting and the upstream to proxied responses (SERVER_TIMING).
+	// Off by default as it exposes internal timing.
+	ServerTiming bool
+	// Pprof mounts the runtime profiling handlers next to the admin API (PPROF)
+	Pprof bool
+
+	Introspection IntrospectionConfig
+	HMAC          HMACConfig
+	Mongo         MongoConfig
+}
+
+var config Config
+
+func loadConfig() Config {
+	cfg := Config{
+		UpstreamTimeout: envDuration("UPSTREAM_TIMEOUT", 30*time.Second),
+		MaxBodySize:     envInt64("MAX_BODY_SIZE", 0),
+		UpstreamRetries: int(envInt64("UPSTREAM_RETRIES", 0)),
+		RetryMaxBody:    envInt64("RETRY_MAX_BODY", 1<<20),
+		RetryBackoff:    envDuration("RETRY_BACKOFF", 100*time.Millisecond),
+		RetryMaxDelay:   envDuration("RETRY_MAX_DELAY", 0),
+		RequestBudget:   envDuration("REQUEST_BUDGET", 0),
+		LatencyBuckets:  envFloats("UPSTREAM_LATENCY_BUCKETS", prometheus.DefBuckets),
+		LatencyLastByte: envBool("UPSTREAM_LATENCY_LAST_BYTE", false),
+		DefaultBackend:  os.Getenv("DEFAULT_BACKEND"),
+		AutoRegister:    envBool("AUTO_REGISTER", false),
+		RequestTimeout:  envDuration("REQUEST_TIMEOUT", 0),
+		CircuitFailures: int(envInt64("CIRCUIT_FAILURES", 0)),
+		CircuitCooldown: envDuration("CIRCUIT_COOLDOWN", 30*time.Second),
+
+		CircuitWindow:         envDuration("CIRCUIT_WINDOW", 0),
+		CircuitHalfOpenProbes: int(envInt64("CIRCUIT_HALF_OPEN_PROBES", 1)),
+
+		EventsWebhookURL: os.Getenv("EVENTS_WEBHOOK_URL"),
+
+		DNSCacheTTL:     envDuration("DNS_CACHE_TTL", 0),
+		ShutdownTimeout: envDuration("SHUTDOWN_TIMEOUT", 30*time.Second),
+		PIDFile:         os.Getenv("PID_FILE"),
+		ExtraMethods:    envList("EXTRA_METHODS"),
+		StripSlashes:    envBool("STRIP_SLASHES", false),
+
+		DisabledMiddlewares: envList("DISABLE_MIDDLEWARES"),
+
+		AppsReloadInterval: envDuration("APPS_RELOAD_INTERVAL", 0),
+		AppLoadWorkers:     int(envInt64("APP_LOAD_WORKERS", int64(runtime.NumCPU()))),
+		TimeoutRetryAfter:  envDuration("TIMEOUT_RETRY_AFTER", 5*time.Second),
+		TrustedProxies:     envCIDRs("TRUSTED_PROXIES"),
+
+		Storage:  envString("STORAGE", "mongo"),
+		AppsFile: os.Getenv("APPS_FILE"),
+
+		StoreHealthInterval: envDuration("STORE_HEALTH_INTERVAL", 5*time.Second),
+
+		RouteBy:     envString("ROUTE_BY", "path"),
+		RouteHeader: envString("ROUTE_HEADER", "X-App-Id"),
+
+		PrefixRoutes: envPrefixRoutes("PREFIX_ROUTES"),
+
+		BasePath: strings.TrimRight(os.Getenv("BASE_PATH"), "/"),
+
+		APIKeysCollection: envString("APIKEYS_COLLECTION", "api_keys"),
+		APIKeyAuth:        envBool("API_KEY_AUTH", false),
+
+		UsageCollection:     envString("USAGE_COLLECTION", "usage"),
+		TenantHeader:        os.Getenv("TENANT_HEADER"),
+		TenantAllowlist:     envList("TENANT_ALLOWLIST"),
+		TenantFlushInterval: envDuration("TENANT_FLUSH_INTERVAL", time.Second),
+
+		UsageFlushInterval:    envDuration("USAGE_FLUSH_INTERVAL", time.Second),
+		UsageFlushBatchSize:   int(envInt64("USAGE_FLUSH_BATCH_SIZE", 500)),
+		UsageFlushConcurrency: int(envInt64("USAGE_FLUSH_CONCURRENCY", 4)),
+
+		UsageHistory:           envBool("USAGE_HISTORY", false),
+		UsageHistoryCollection: envString("USAGE_HISTORY_COLLECTION", "usage_hourly"),
+
+		UsageHistoryBatchSize:        int(envInt64("USAGE_HISTORY_BATCH_SIZE", 500)),
+		UsageHistoryFlushConcurrency: int(envInt64("USAGE_HISTORY_FLUSH_CONCURRENCY", 4)),
+
+		MaxConnections: int(envInt64("MAX_CONNECTIONS", 0)),
+		IdleTimeout:    envDuration("IDLE_TIMEOUT", 90*time.Second),
+
+		ThrottleLimit:          int(envInt64("THROTTLE_LIMIT", 0)),
+		ThrottleBacklog:        int(envInt64("THROTTLE_BACKLOG", 0)),
+		ThrottleBacklogTimeout: envDuration("THROTTLE_BACKLOG_TIMEOUT", time.Minute),
+
+		MaxRequestsPerIP: int(envInt64("MAX_REQUESTS_PER_IP", 0)),
+		IPAllowlist:      envCIDRs("IP_LIMIT_ALLOWLIST"),
+
+		WarmupConns:         int(envInt64("WARMUP_CONNS", 0)),
+		WarmupPath:          envString("WARMUP_PATH", "/"),
+		WarmupRetryInterval: envDuration("WARMUP_RETRY_INTERVAL", 30*time.Second),
+
+		KubernetesDiscovery: envBool("K8S_DISCOVERY", false),
+		ConsulAddr:          envString("CONSUL_ADDR", "http://127.0.0.1:8500"),
+		ConsulToken:         os.Getenv("CONSUL_TOKEN"),
+
+		ResponseBufferSize:    int(envInt64("RESPONSE_BUFFER_SIZE", 32<<10)),
+		ResponseFlushInterval: envDuration("RESPONSE_FLUSH_INTERVAL", 100*time.Millisecond),
+
+		RewriteMaxBody: envInt64("REWRITE_MAX_BODY", 1<<20),
+
+		CacheMaxEntries: int(envInt64("CACHE_MAX_ENTRIES", 10000)),
+		CacheMaxBody:    envInt64("CACHE_MAX_BODY", 1<<20),
+
+		LogSampleRate:    int(envInt64("LOG_SAMPLE_RATE", 1)),
+		LogSlowThreshold: envDuration("LOG_SLOW_THRESHOLD", time.Second),
+
+		LogFile:           os.Getenv("LOG_FILE"),
+		LogMaxSizeMB:      int(envInt64("LOG_MAX_SIZE", 100)),
+		LogRotateInterval: envDuration("LOG_ROTATE_INTERVAL", 0),
+		LogMaxBackups:     int(envInt64("LOG_MAX_BACKUPS", 0)),
+		LogMaxAgeDays:     int(envInt64("LOG_MAX_AGE", 0)),
+		LogCompress:       envBool("LOG_COMPRESS", false),
+
+		OTLPEndpoint:    os.Getenv("OTLP_ENDPOINT"),
+		OTLPServiceName: envString("OTEL_SERVICE_NAME", "gateway"),
+		OTLPLogsOnly:    envBool("OTLP_LOGS_ONLY", false),
+
+		GeoIPDB: os.Getenv("GEOIP_DB"),
+
+		ErrorPagesDir: os.Getenv("ERROR_PAGES_DIR"),
+
+		QuotaCycleDay: int(envInt64("QUOTA_CYCLE_DAY", 1)),
+		QuotaStatus:   int(envInt64("QUOTA_STATUS", http.StatusTooManyRequests)),
+
+		AppPort:    os.Getenv("APP_PORT"),
+		ViaToken:   os.Getenv("VIA_TOKEN"),
+		AdminPort:  os.Getenv("ADMIN_PORT"),
+		AdminToken: os.Getenv("ADMIN_TOKEN"),
+		Pprof:      envBool("PPROF", false),
+
+		UpstreamOverride: envBool("UPSTREAM_OVERRIDE", false),
+		ServerTiming:     envBool("SERVER_TIMING", false),
+
+		Compression:        envBool("COMPRESSION", false),
+		CompressionLevel:   int(envInt64("COMPRESSION_LEVEL", 5)),
+		CompressionMinSize: int(envInt64("COMPRESSION_MIN_SIZE", 1024)),
+		CompressionTypes:   envList("COMPRESSION_TYPES"),
+
+		LimitBypassPaths: envList("LIMIT_BYPASS_PATHS"),
+
+		Introspection: IntrospectionConfig{
+			URL:          os.Getenv("INTROSPECTION_URL"),
+			ClientID:     os.Getenv("INTROSPECTION_CLIENT_ID"),
+			ClientSecret: os.Getenv("INTROSPECTION_CLIENT_SECRET"),
+			CacheTTL:     envDuration("INTROSPECTION_CACHE_TTL", 30*time.Second),
+		},
+		HMAC: HMACConfig{
+			Enabled: envBool("HMAC_AUTH", false),
+			MaxSkew: envDuration("HMAC_MAX_SKEW", 5*time.Minute),
+		},
+		Mongo: MongoConfig{
+			MaxPoolSize:    int(envInt64("MONGO_MAX_POOL_SIZE", 0)),
+			ConnectTimeout: envDuration("MONGO_CONNECT_TIMEOUT", 0),
+			SocketTimeout:  envDuration("MONGO_SOCKET_TIMEOUT", 0),
+			ReadConcern:    os.Getenv("MONGO_READ_CONCERN"),
+			WriteConcern:   os.Getenv("MONGO_WRITE_CONCERN"),
+			TLSCAFile:      os.Getenv("MONGO_TLS_CA_FILE"),
+
+			UsageWriteConcern: os.Getenv("USAGE_WRITE_CONCERN"),
+		},
+	}
+
+	if cfg.Storage != "mongo" && cfg.Storage != "memory" {
+		log.Fatalf("Invalid STORAGE %q: must be mongo or memory", cfg.Storage)
+	}
+	if cfg.StoreHealthInterval <= 0 {
+		log.Fatalf("Invalid STORE_HEALTH_INTERVAL %s: must be positive", cfg.StoreHealthInterval)
+	}
+	if cfg.RouteBy != "path" && cfg.RouteBy != "header" {
+		log.Fatalf("Invalid ROUTE_BY %q: must be path or header", cfg.RouteBy)
+	}
+	if cfg.BasePath != "" && (!strings.HasPrefix(cfg.BasePath, "/") || strings.ContainsAny(cfg.BasePath, "{}*")) {
+		log.Fatalf("Invalid BASE_PATH %q: must start with / and not contain route patterns", cfg.BasePath)
+	}
+	if cfg.CircuitFailures < 0 || cfg.CircuitWindow < 0 || cfg.CircuitHalfOpenProbes < 1 {
+		log.Fatalf("Invalid CIRCUIT_FAILURES %d, CIRCUIT_WINDOW %s or CIRCUIT_HALF_OPEN_PROBES %d: the failures and window must not be negative and there must be a probe", cfg.CircuitFailures, cfg.CircuitWindow, cfg.CircuitHalfOpenProbes)
+	}
+	if cfg.UpstreamOverride && cfg.AdminToken == "" {
+		log.Fatalf("UPSTREAM_OVERRIDE requires ADMIN_TOKEN")
+	}
+	if cfg.WarmupConns > 0 && (!strings.HasPrefix(cfg.WarmupPath, "/") || cfg.WarmupRetryInterval <= 0) {
+		log.Fatalf("Invalid WARMUP_PATH %q or WARMUP_RETRY_INTERVAL %s: the path must start with / and the interval be positive", cfg.WarmupPath, cfg.WarmupRetryInterval)
+	}
+	if cfg.CompressionLevel < gzip.BestSpeed || cfg.CompressionLevel > gzip.BestCompression {
+		log.Fatalf("Invalid COMPRESSION_LEVEL %d: must be between 1 and 9", cfg.CompressionLevel)
+	}
+	if cfg.CompressionMinSize < 0 {
+		log.Fatalf("Invalid COMPRESSION_MIN_SIZE %d: must not be negative", cfg.CompressionMinSize)
+	}
+	if cfg.TenantHeader != "" && len(cfg.TenantAllowlist) == 0 {
+		log.Fatalf("TENANT_HEADER requires TENANT_ALLOWLIST")
+	}
+	if cfg.UsageFlushInterval <= 0 || cfg.UsageFlushBatchSize < 1 || cfg.UsageFlushConcurrency < 1 {
+		log.Fatalf("Invalid USAGE_FLUSH_INTERVAL %s, USAGE_FLUSH_BATCH_SIZE %d or USAGE_FLUSH_CONCURRENCY %d: must be positive", cfg.UsageFlushInterval, cfg.UsageFlushBatchSize, cfg.UsageFlushConcurrency)
+	}
+	if cfg.TenantFlushInterval <= 0 {
+		log.Fatalf("Invalid TENANT_FLUSH_INTERVAL %s: must be positive", cfg.TenantFlushInterval)
+	}
+	if cfg.UsageHistoryBatchSize < 1 || cfg.UsageHistoryFlushConcurrency < 1 {
+		log.Fatalf("Invalid USAGE_HISTORY_BATCH_SIZE %d or USAGE_HISTORY_FLUSH_CONCURRENCY %d: must be positive", cfg.UsageHistoryBatchSize, cfg.UsageHistoryFlushConcurrency)
+	}
+	for _, p := range cfg.LimitBypassPaths {
+		if !strings.HasPrefix(p, "/") {
+			log.Fatalf("Invalid LIMIT_BYPASS_PATHS entry %q: must start with /", p)
+		}
+	}
+	if cfg.CompressionTypes == nil {
+		cfg.CompressionTypes = []string{"text/*", "application/json", "application/xml", "application/javascript", "image/svg+xml"}
+	}
+	if cfg.QuotaCycleDay < 1 || cfg.QuotaCycleDay > 28 {
+		log.Fatalf("Invalid QUOTA_CYCLE_DAY %d: must be between 1 and 28", cfg.QuotaCycleDay)
+	}
+	if cfg.QuotaStatus != http.StatusTooManyRequests && cfg.QuotaStatus != http.StatusPaymentRequired {
+		log.Fatalf("Invalid QUOTA_STATUS %d: must be 429 or 402", cfg.QuotaStatus)
+	}
+	if cfg.RequestTimeout > 0 && (cfg.UpstreamTimeout >= cfg.RequestTimeout || cfg.RequestBudget >= cfg.RequestTimeout) {
+		log.Printf("REQUEST_TIMEOUT %s is not longer than UPSTREAM_TIMEOUT/REQUEST_BUDGET; slow upstreams will get 503 instead of 504", cfg.RequestTimeout)
+	}
+	return cfg
+}
+
+func envString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// envList parses a comma separated list, dropping empty entries
+func envList(key string) []string {
+	var list []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// envCIDRs parses a comma separated list of CIDRs; bare addresses are taken
+// as a single host
+func envCIDRs(key string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				log.Fatalf("Invalid %s entry %q", key, v)
+			}
+			bits := 8 * len(ip.To4())
+			if bits == 0 {
+				bits = 128
+			}
+			v = ip.String() + "/" + strconv.Itoa(bits)
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			log.Fatalf("Invalid %s entry %q: %v", key, v, err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
+
+// envPrefixRoutes parses a comma separated list of pattern=port rules,
+// keeping their order
+func envPrefixRoutes(key string) []PrefixRoute {
+	var routes []PrefixRoute
+	for _, v := range envList(key) {
+		pattern, portStr, ok := strings.Cut(v, "=")
+		pattern = strings.TrimSpace(pattern)
+		port, err := strconv.Atoi(strings.TrimSpace(portStr))
+		if !ok || !strings.HasPrefix(pattern, "/") || err != nil || port < 1 || port > 65535 {
+			log.Fatalf("Invalid %s entry %q: must be /path=port or /prefix/*=port", key, v)
+		}
+		routes = append(routes, PrefixRoute{Pattern: pattern, Port: port})
+	}
+	return routes
+}
+
+// envFloats parses a comma separated list of increasing numbers
+func envFloats(key string, def []float64) []float64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var fs []float64
+	for _, part := range strings.Split(v, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			log.Fatalf("Invalid %s %q: %v", key, v, err)
+		}
+		if len(fs) > 0 && f <= fs[len(fs)-1] {
+			log.Fatalf("Invalid %s %q: values must increase", key, v)
+		}
+		fs = append(fs, f)
+	}
+	return fs
+}
+
+func envDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, v, err)
+	}
+	return d
+}
+
+func envInt64(key string, def int64) int64 {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, v, err)
+	}
+	return n
+}
+
+func envBool(key string, def bool) bool {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		log.Fatalf("Invalid %s %q: %v", key, v, err)
+	}
+	return b
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ConsulDiscovery fills the app's instances with the passing instances of a
+// service in the Consul catalog
+type ConsulDiscovery struct {
+	Service    string `bson:"service"`
+	Tag        string `bson:"tag,omitempty"`
+	Datacenter string `bson:"datacenter,omitempty"`
+}
+
+// The subset of a /v1/health/service entry used here
+type consulServiceEntry struct {
+	Node struct {
+		Address string `json:"Address"`
+	} `json:"Node"`
+	Service struct {
+		Address string `json:"Address"`
+		Port    int    `json:"Port"`
+	} `json:"Service"`
+}
+
+var consulClient = &http.Client{Timeout: 6 * time.Minute}
+
+// consulInstances runs a blocking query for the service's passing instances.
+// It returns once the result changes past index or Consul's wait time
+// elapses, along with the index to block on next.
+func consulInstances(ctx context.Context, cd ConsulDiscovery, index uint64) ([]*Instance, uint64, error) {
+	q := url.Values{"passing": {"true"}, "wait": {"5m"}}
+	if index > 0 {
+		q.Set("index", strconv.FormatUint(index, 10))
+	}
+	if cd.Tag != "" {
+		q.Set("tag", cd.Tag)
+	}
+	if cd.Datacenter != "" {
+		q.Set("dc", cd.Datacenter)
+	}
+	u := fmt.Sprintf("%s/v1/health/service/%s?%s", config.ConsulAddr, url.PathEscape(cd.Service), q.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if config.ConsulToken != "" {
+		req.Header.Set("X-Consul-Token", config.ConsulToken)
+	}
+	resp, err := consulClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("consul returned %s", resp.Status)
+	}
+
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+	instances := make([]*Instance, 0, len(entries))
+	for _, e := range entries {
+		// An empty service address means the service uses the node's
+		addr := e.Service.Address
+		if addr == "" {
+			addr = e.Node.Address
+		}
+		instances = append(instances, &Instance{Addr: net.JoinHostPort(addr, strconv.Itoa(e.Service.Port))})
+	}
+	next, _ := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	return instances, next, nil
+}
+
+// watchConsul keeps the app's discovered instances in sync with the Consul
+// catalog until ctx is done. While Consul is unreachable the last known
+// instances keep serving.
+func watchConsul(ctx context.Context, port int, cd ConsulDiscovery) {
+	var index uint64
+	backoff := time.Second
+	for ctx.Err() == nil {
+		instances, next, err := consulInstances(ctx, cd, index)
+		if err == nil {
+			setDiscovered(port, instances)
+			// Consul asks clients to start over when the index goes backwards
+			if next < index {
+				next = 0
+			}
+			index = next
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("Consul discovery for app %d: %v", port, err)
+		index = 0
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
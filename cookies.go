@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// CookieRewrite rewrites the Domain and Path attributes of the app's
+// Set-Cookie headers, for backends that set cookies for their internal host
+// or paths
+type CookieRewrite struct {
+	Domains []CookieRule `bson:"domains,omitempty"`
+	Paths   []CookieRule `bson:"paths,omitempty"`
+}
+
+// CookieRule replaces From with To. Domains match case-insensitively and
+// ignore a leading dot; an empty To drops the attribute, making the cookie
+// host-only. Paths match From as a prefix, which is replaced by To.
+type CookieRule struct {
+	From string `bson:"from"`
+	To   string `bson:"to"`
+}
+
+// appCookiePath is the path the gateway's own cookies for the app on port
+// are scoped to: the app's mount under BASE_PATH when r was routed by its
+// app ID, otherwise, with ROUTE_BY=header or PREFIX_ROUTES, where the app
+// does not own a path of its own, the whole of BASE_PATH.
+func appCookiePath(r *http.Request, port int) string {
+	if config.RouteBy == "path" && chi.URLParam(r, "appID") == strconv.Itoa(port) {
+		return config.BasePath + "/" + strconv.Itoa(port)
+	}
+	if config.BasePath == "" {
+		return "/"
+	}
+	return config.BasePath
+}
+
+// rewriteCookies applies the app's cookie rules to every Set-Cookie header
+// in h. Only the Domain and Path attributes are touched; the rest of each
+// cookie, including attributes Go does not know, is kept byte for byte.
+func rewriteCookies(app *App, h http.Header) {
+	if app == nil || app.CookieRewrite == nil {
+		return
+	}
+	cookies := h.Values("Set-Cookie")
+	if len(cookies) == 0 {
+		return
+	}
+	out := make([]string, 0, len(cookies))
+	for _, c := range cookies {
+		out = append(out, app.CookieRewrite.rewrite(c))
+	}
+	h["Set-Cookie"] = out
+}
+
+// rewrite rewrites a single Set-Cookie value. Cookie values cannot contain
+// ";" (RFC 6265), so splitting on it yields the name=value pair followed by
+// the attributes.
+func (cr *CookieRewrite) rewrite(cookie string) string {
+	parts := strings.Split(cookie, ";")
+	out := parts[:1]
+	for _, attr := range parts[1:] {
+		name, value, _ := strings.Cut(strings.TrimSpace(attr), "=")
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			to, ok := cr.domain(strings.TrimSpace(value))
+			if !ok {
+				break
+			}
+			if to == "" {
+				continue
+			}
+			attr = " Domain=" + to
+		case "path":
+			to, ok := cr.path(strings.TrimSpace(value))
+			if !ok {
+				break
+			}
+			attr = " Path=" + to
+		}
+		out = append(out, attr)
+	}
+	return strings.Join(out, ";")
+}
+
+func (cr *CookieRewrite) domain(d string) (string, bool) {
+	d = strings.TrimPrefix(d, ".")
+	for _, rule := range cr.Domains {
+		if strings.EqualFold(d, strings.TrimPrefix(rule.From, ".")) {
+			return rule.To, true
+		}
+	}
+	return "", false
+}
+
+func (cr *CookieRewrite) path(p string) (string, bool) {
+	for _, rule := range cr.Paths {
+		if rest, ok := strings.CutPrefix(p, rule.From); ok {
+			to := rule.To + rest
+			if to == "" {
+				to = "/"
+			}
+			return to, true
+		}
+	}
+	return "", false
+}
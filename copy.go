@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// copyResponse sends the upstream body to the client. By default writes are
+// coalesced in a RESPONSE_BUFFER_SIZE buffer, flushed when full or
+// RESPONSE_FLUSH_INTERVAL after data was first buffered, so many small
+// upstream chunks don't become many tiny writes. Event streams, apps with
+// Streaming set, and a zero buffer size stream instead, flushing every chunk
+// as it arrives.
+func copyResponse(w http.ResponseWriter, app *App, resp *http.Response) {
+	if config.ResponseBufferSize <= 0 || streamed(app, resp) {
+		io.Copy(streamWriter{w}, resp.Body)
+		return
+	}
+	fw := &flushWriter{w: w, bw: bufio.NewWriterSize(w, config.ResponseBufferSize), interval: config.ResponseFlushInterval}
+	io.Copy(fw, resp.Body)
+	fw.close()
+}
+
+func streamed(app *App, resp *http.Response) bool {
+	if app != nil && app.Streaming {
+		return true
+	}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/event-stream"
+}
+
+// streamWriter flushes after every write
+type streamWriter struct {
+	w http.ResponseWriter
+}
+
+func (s streamWriter) Write(p []byte) (int, error) {
+	n, err := s.w.Write(p)
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// flushWriter buffers writes and flushes them after at most interval, so a
+// slow trickle from upstream is not held back indefinitely
+type flushWriter struct {
+	w        http.ResponseWriter
+	bw       *bufio.Writer
+	interval time.Duration
+
+	mu      sync.Mutex
+	timer   *time.Timer
+	pending bool
+}
+
+func (fw *flushWriter) Write(p []byte) (int, error) {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	n, err := fw.bw.Write(p)
+	if fw.interval > 0 && !fw.pending && fw.bw.Buffered() > 0 {
+		fw.pending = true
+		if fw.timer == nil {
+			fw.timer = time.AfterFunc(fw.interval, fw.delayedFlush)
+		} else {
+			fw.timer.Reset(fw.interval)
+		}
+	}
+	return n, err
+}
+
+func (fw *flushWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if !fw.pending {
+		return
+	}
+	fw.pending = false
+	fw.flush()
+}
+
+func (fw *flushWriter) flush() {
+	fw.bw.Flush()
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// close writes out what is left; nothing may be written afterwards
+func (fw *flushWriter) close() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.timer != nil {
+		fw.timer.Stop()
+	}
+	fw.pending = false
+	fw.bw.Flush()
+}
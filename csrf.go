@@ -0,0 +1,82 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// CSRFProtection guards browser-facing apps with double-submit tokens: the
+// gateway hands out a token in a cookie on safe requests, and unsafe
+// requests must echo it in a header.
+type CSRFProtection struct {
+	// Cookie names the token cookie (default csrf_token)
+	Cookie string `bson:"cookie,omitempty"`
+	// Header carries the token on unsafe requests (default X-CSRF-Token)
+	Header string `bson:"header,omitempty"`
+}
+
+func (c *CSRFProtection) cookieName() string {
+	if c.Cookie != "" {
+		return c.Cookie
+	}
+	return "csrf_token"
+}
+
+func (c *CSRFProtection) headerName() string {
+	if c.Header != "" {
+		return c.Header
+	}
+	return "X-CSRF-Token"
+}
+
+func isSafeMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
+
+// checkCSRF enforces the app's CSRF protection on r, writing 403 when an
+// unsafe request's token is missing or does not match its cookie. Safe
+// requests without a token cookie are issued one. It reports whether the
+// request may proceed.
+func checkCSRF(w http.ResponseWriter, r *http.Request, port int, app *App) bool {
+	if app == nil || app.CSRF == nil {
+		return true
+	}
+	c := app.CSRF
+	cookie, err := r.Cookie(c.cookieName())
+	if isSafeMethod(r.Method) {
+		if err != nil || cookie.Value == "" {
+			issueCSRFToken(w, r, port, c)
+		}
+		return true
+	}
+
+	token := r.Header.Get(c.headerName())
+	if err != nil || cookie.Value == "" || token == "" ||
+		subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token)) != 1 {
+		http.Error(w, "Invalid CSRF token", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// issueCSRFToken sets a fresh token cookie scoped to the app's path. It is
+// readable by scripts, which need to copy it into the header.
+func issueCSRFToken(w http.ResponseWriter, r *http.Request, port int, c *CSRFProtection) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     c.cookieName(),
+		Value:    hex.EncodeToString(b),
+		Path:     appCookiePath(r, port),
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
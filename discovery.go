@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// Discovery selects where an app's instances come from when they are not
+// listed statically. Exactly one source should be set.
+type Discovery struct {
+	Kubernetes *KubernetesDiscovery `bson:"kubernetes,omitempty"`
+	Consul     *ConsulDiscovery     `bson:"consul,omitempty"`
+	SRV        *SRVDiscovery        `bson:"srv,omitempty"`
+}
+
+// describe returns a string identifying the source, used to notice when
+// an app's discovery settings change on reload
+func (d *Discovery) describe() string {
+	switch {
+	case d.Kubernetes != nil:
+		return fmt.Sprintf("kubernetes:%+v", *d.Kubernetes)
+	case d.Consul != nil:
+		return fmt.Sprintf("consul:%+v", *d.Consul)
+	case d.SRV != nil:
+		return "srv:" + d.SRV.Name
+	}
+	return ""
+}
+
+// run keeps the app's discovered instances up to date until ctx is done
+func (d *Discovery) run(ctx context.Context, port int) {
+	switch {
+	case d.Kubernetes != nil:
+		if !config.KubernetesDiscovery {
+			log.Printf("App %d uses Kubernetes discovery but K8S_DISCOVERY is off", port)
+			return
+		}
+		watchKubernetes(ctx, port, *d.Kubernetes)
+	case d.Consul != nil:
+		watchConsul(ctx, port, *d.Consul)
+	case d.SRV != nil:
+		watchSRV(ctx, port, *d.SRV)
+	}
+}
+
+// discoveryWatchers tracks the running discovery loop of each app
+var discoveryWatchers = struct {
+	sync.Mutex
+	m map[int]discoveryWatcher
+}{m: make(map[int]discoveryWatcher)}
+
+type discoveryWatcher struct {
+	source string
+	cancel context.CancelFunc
+}
+
+// syncDiscovery starts discovery for apps that gained a source, and stops or
+// restarts it for apps whose source was removed or changed
+func syncDiscovery(apps map[int]*App) {
+	discoveryWatchers.Lock()
+	defer discoveryWatchers.Unlock()
+
+	for port, w := range discoveryWatchers.m {
+		app, ok := apps[port]
+		if !ok || app.Discovery == nil || app.Discovery.describe() != w.source {
+			w.cancel()
+			delete(discoveryWatchers.m, port)
+		}
+	}
+	for port, app := range apps {
+		if app.Discovery == nil {
+			continue
+		}
+		if _, ok := discoveryWatchers.m[port]; ok {
+			continue
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		discoveryWatchers.m[port] = discoveryWatcher{source: app.Discovery.describe(), cancel: cancel}
+		go app.Discovery.run(ctx, port)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var dnsLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_dns_cache_lookups_total",
+	Help: "Upstream host lookups by DNS cache result (hit or miss).",
+}, []string{"result"})
+
+// dnsCache remembers resolved upstream addresses for ttl. Go's resolver does
+// not expose record TTLs, so ttl (DNS_CACHE_TTL) is applied to every host
+// and should be kept below the lowest TTL of services that move around.
+type dnsCache struct {
+	sync.Mutex
+	ttl      time.Duration
+	resolver *net.Resolver
+	entries  map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []string
+	expires time.Time
+}
+
+var upstreamDNS = &dnsCache{
+	resolver: net.DefaultResolver,
+	entries:  make(map[string]dnsEntry),
+}
+
+func (c *dnsCache) lookup(ctx context.Context, host string) ([]string, error) {
+	c.Lock()
+	e, ok := c.entries[host]
+	c.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		dnsLookups.WithLabelValues("hit").Inc()
+		return e.addrs, nil
+	}
+	dnsLookups.WithLabelValues("miss").Inc()
+
+	addrs, err := c.resolver.LookupHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	c.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, expires: time.Now().Add(c.ttl)}
+	c.Unlock()
+	return addrs, nil
+}
+
+// flush forgets every cached host
+func (c *dnsCache) flush() {
+	c.Lock()
+	c.entries = make(map[string]dnsEntry)
+	c.Unlock()
+}
+
+// dialContext resolves the host through the cache and dials the addresses
+// in turn until one connects
+func (c *dnsCache) dialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			return dial(ctx, network, addr)
+		}
+		addrs, err := c.lookup(ctx, host)
+		if err != nil {
+			return nil, err
+		}
+		var firstErr error
+		for _, a := range addrs {
+			conn, err := dial(ctx, network, net.JoinHostPort(a, port))
+			if err == nil {
+				return conn, nil
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		return nil, firstErr
+	}
+}
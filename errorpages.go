@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// errorPage is a gateway-branded body served in place of an upstream error
+type errorPage struct {
+	contentType string
+	tmpl        *template.Template
+}
+
+// errorPages maps status codes to their replacement page, loaded once from
+// ERROR_PAGES_DIR at startup
+var errorPages = map[int]*errorPage{}
+
+// loadErrorPages reads files named after a status code ("502.html",
+// "503.json", ...) from dir. Each file is a text/template rendered with
+// .Status, .StatusText and .Port; its extension sets the Content-Type.
+func loadErrorPages(dir string) (map[int]*errorPage, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	pages := make(map[int]*errorPage)
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		ext := filepath.Ext(e.Name())
+		status, err := strconv.Atoi(strings.TrimSuffix(e.Name(), ext))
+		if err != nil || status < 400 || status > 599 {
+			log.Printf("Skipping error page %s: name is not an error status code", e.Name())
+			continue
+		}
+		tmpl, err := template.ParseFiles(filepath.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		contentType := mime.TypeByExtension(ext)
+		if contentType == "" {
+			contentType = "text/plain; charset=utf-8"
+		}
+		pages[status] = &errorPage{contentType: contentType, tmpl: tmpl}
+	}
+	return pages, nil
+}
+
+// writeErrorPage replaces the upstream response with the configured page for
+// its status. It reports false, writing nothing, when the app has custom error
+// pages disabled or no page exists for the status.
+func writeErrorPage(w http.ResponseWriter, app *App, status int) bool {
+	if app == nil || !app.ErrorPages {
+		return false
+	}
+	page, ok := errorPages[status]
+	if !ok {
+		return false
+	}
+
+	var buf bytes.Buffer
+	data := struct {
+		Status     int
+		StatusText string
+		Port       int
+	}{status, http.StatusText(status), app.Port}
+	if err := page.tmpl.Execute(&buf, data); err != nil {
+		log.Printf("Error rendering error page for status %d: %v", status, err)
+		return false
+	}
+
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	w.WriteHeader(status)
+	w.Write(buf.Bytes())
+	return true
+}
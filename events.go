@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var stateTransitions = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_state_transitions_total",
+	Help: "Circuit breaker and health check state changes, per app.",
+}, []string{"app", "kind", "from", "to"})
+
+// stateEvent is a circuit breaker (kind "circuit") or instance health
+// (kind "health") state change
+type stateEvent struct {
+	Time     time.Time `json:"time"`
+	Kind     string    `json:"kind"`
+	App      int       `json:"app"`
+	Instance string    `json:"instance,omitempty"`
+	From     string    `json:"from"`
+	To       string    `json:"to"`
+	// Error is what triggered the change, empty for a recovery
+	Error string `json:"error,omitempty"`
+}
+
+// events queues the events for EVENTS_WEBHOOK_URL, so a slow receiver never
+// holds up requests; when it is full events are only logged
+var events = struct {
+	once  sync.Once
+	queue chan stateEvent
+}{queue: make(chan stateEvent, 100)}
+
+// emitEvent logs the state change as key=value pairs, counts it and, with
+// EVENTS_WEBHOOK_URL set, POSTs it there as JSON
+func emitEvent(e stateEvent) {
+	e.Time = time.Now()
+	line := fmt.Sprintf("event=state_change kind=%s app=%d", e.Kind, e.App)
+	if e.Instance != "" {
+		line += " instance=" + e.Instance
+	}
+	line += fmt.Sprintf(" from=%s to=%s", e.From, e.To)
+	if e.Error != "" {
+		line += fmt.Sprintf(" error=%q", e.Error)
+	}
+	log.Print(line)
+	stateTransitions.WithLabelValues(strconv.Itoa(e.App), e.Kind, e.From, e.To).Inc()
+
+	if config.EventsWebhookURL == "" {
+		return
+	}
+	events.once.Do(func() { go postEvents(config.EventsWebhookURL) })
+	select {
+	case events.queue <- e:
+	default:
+		log.Printf("Events webhook queue is full, dropping %s event for app %d", e.Kind, e.App)
+	}
+}
+
+func postEvents(url string) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	for e := range events.queue {
+		body, _ := json.Marshal(e)
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error posting event to webhook: %v", err)
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error posting event to webhook: %v", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Events webhook answered %d", resp.StatusCode)
+		}
+	}
+}
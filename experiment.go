@@ -0,0 +1,114 @@
+package main
+
+import (
+	"hash/fnv"
+	"net/http"
+	"time"
+)
+
+// Experiment splits an app's clients between variant backends for A/B
+// tests. Clients are bucketed by a hash of their IP and then kept in their
+// variant by a cookie, so changing the weights only moves new clients.
+type Experiment struct {
+	// Name identifies the experiment in the bucketing hash
+	Name string `bson:"name"`
+	// Cookie keeps the client's variant (default gw_variant)
+	Cookie string `bson:"cookie,omitempty"`
+	// Header tells the backend the variant (default X-Variant)
+	Header   string    `bson:"header,omitempty"`
+	Variants []Variant `bson:"variants"`
+}
+
+// Variant is one arm of an experiment. Upstream may be empty to use the
+// app's usual pool.
+type Variant struct {
+	Name     string `bson:"name"`
+	Weight   int    `bson:"weight"`
+	Upstream string `bson:"upstream,omitempty"`
+}
+
+func (e *Experiment) cookieName() string {
+	if e.Cookie != "" {
+		return e.Cookie
+	}
+	return "gw_variant"
+}
+
+func (e *Experiment) headerName() string {
+	if e.Header != "" {
+		return e.Header
+	}
+	return "X-Variant"
+}
+
+func (e *Experiment) variant(name string) (*Variant, bool) {
+	for i := range e.Variants {
+		if e.Variants[i].Name == name && e.Variants[i].Weight > 0 {
+			return &e.Variants[i], true
+		}
+	}
+	return nil, false
+}
+
+// bucket deterministically picks a variant for the client by weight
+func (e *Experiment) bucket(client string) (*Variant, bool) {
+	total := 0
+	for _, v := range e.Variants {
+		if v.Weight > 0 {
+			total += v.Weight
+		}
+	}
+	if total == 0 {
+		return nil, false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(e.Name + "\x00" + client))
+	n := int(h.Sum32() % uint32(total))
+	for i := range e.Variants {
+		if e.Variants[i].Weight <= 0 {
+			continue
+		}
+		if n < e.Variants[i].Weight {
+			return &e.Variants[i], true
+		}
+		n -= e.Variants[i].Weight
+	}
+	return nil, false
+}
+
+// assignVariant puts the request in a variant: the one in its cookie if
+// still running, otherwise one bucketed by client IP, which is then made
+// sticky with a cookie. The variant is passed to the backend in the
+// experiment header, replacing anything the client sent.
+func assignVariant(w http.ResponseWriter, r *http.Request, port int, e *Experiment) {
+	r.Header.Del(e.headerName())
+	var v *Variant
+	var ok bool
+	if c, err := r.Cookie(e.cookieName()); err == nil {
+		v, ok = e.variant(c.Value)
+	}
+	if !ok {
+		if v, ok = e.bucket(clientIP(r)); !ok {
+			return
+		}
+		http.SetCookie(w, &http.Cookie{
+			Name:     e.cookieName(),
+			Value:    v.Name,
+			Path:     appCookiePath(r, port),
+			MaxAge:   int((30 * 24 * time.Hour).Seconds()),
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	r.Header.Set(e.headerName(), v.Name)
+}
+
+// upstream returns the backend of the variant assignVariant chose
+func (e *Experiment) upstream(r *http.Request) (string, bool) {
+	v, ok := e.variant(r.Header.Get(e.headerName()))
+	if !ok || v.Upstream == "" {
+		return "", false
+	}
+	return v.Upstream, true
+}
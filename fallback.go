@@ -0,0 +1,18 @@
+package main
+
+import "net/http"
+
+// serveDefault answers requests that name no registered app: they are
+// proxied to DEFAULT_BACKEND when one is configured, and get a JSON 404
+// otherwise. No usage is counted for them.
+func serveDefault(w http.ResponseWriter, r *http.Request) {
+	if config.DefaultBackend == "" {
+		routeNotFound(w, r)
+		return
+	}
+	proxyRequest(proxyTarget{
+		upstream: config.DefaultBackend,
+		timeout:  config.UpstreamTimeout,
+		maxBody:  config.MaxBodySize,
+	}, w, r)
+}
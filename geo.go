@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// GeoRouting sends requests to region-specific instances by the country of
+// the client IP. It needs a gateway built with -tags geoip and GEOIP_DB set;
+// otherwise no country is known and requests use the app's pool.
+type GeoRouting struct {
+	// Regions are checked in order; the first listing the country wins
+	Regions []GeoRegion `bson:"regions"`
+}
+
+// GeoRegion is a group of countries served by one upstream
+type GeoRegion struct {
+	Name string `bson:"name,omitempty"`
+	// Countries are ISO 3166-1 alpha-2 codes, e.g. "DE"
+	Countries []string `bson:"countries"`
+	Upstream  string   `bson:"upstream"`
+}
+
+// resolve returns the upstream for the request's country
+func (g *GeoRouting) resolve(r *http.Request) (string, bool) {
+	country := lookupCountry(clientIP(r))
+	if country == "" {
+		return "", false
+	}
+	for _, region := range g.Regions {
+		for _, c := range region.Countries {
+			if strings.EqualFold(c, country) {
+				return region.Upstream, true
+			}
+		}
+	}
+	return "", false
+}
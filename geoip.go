@@ -0,0 +1,34 @@
+//go:build geoip
+
+package main
+
+import (
+	"net"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+var geoDB *geoip2.Reader
+
+// openGeoIP loads the MaxMind country (or city) database at path
+func openGeoIP(path string) error {
+	db, err := geoip2.Open(path)
+	if err != nil {
+		return err
+	}
+	geoDB = db
+	return nil
+}
+
+// lookupCountry returns the ISO country code of ip, "" when unknown
+func lookupCountry(ip string) string {
+	parsed := net.ParseIP(ip)
+	if geoDB == nil || parsed == nil {
+		return ""
+	}
+	rec, err := geoDB.Country(parsed)
+	if err != nil {
+		return ""
+	}
+	return rec.Country.IsoCode
+}
@@ -0,0 +1,15 @@
+//go:build !geoip
+
+package main
+
+import "errors"
+
+// openGeoIP fails: GeoIP lookups are only compiled in with -tags geoip, so
+// the MaxMind reader costs nothing when unused
+func openGeoIP(path string) error {
+	return errors.New("gateway built without GeoIP support; rebuild with -tags geoip")
+}
+
+func lookupCountry(ip string) string {
+	return ""
+}
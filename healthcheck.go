@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var instanceHealthy = promauto.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "gateway_instance_healthy",
+	Help: "Whether an instance of an app with health checks passes them.",
+}, []string{"app", "instance"})
+
+// HealthCheck actively probes each of the app's instances with a GET for
+// Path. An instance is taken out of the pool after UnhealthyThreshold
+// failed checks in a row and put back after HealthyThreshold passed ones,
+// so a single blip doesn't make it flap. Instances start out healthy.
+type HealthCheck struct {
+	// Path is requested on each instance (default "/health")
+	Path string `bson:"path,omitempty"`
+	// IntervalMS is the time between checks of an instance (default 10s,
+	// at least 1s)
+	IntervalMS int64 `bson:"interval_ms,omitempty"`
+	// TimeoutMS bounds each check (default 2s)
+	TimeoutMS int64 `bson:"timeout_ms,omitempty"`
+	// HealthyThreshold and UnhealthyThreshold are the consecutive passes
+	// and failures that change an instance's state (defaults 2 and 3)
+	HealthyThreshold   int `bson:"healthy_threshold,omitempty"`
+	UnhealthyThreshold int `bson:"unhealthy_threshold,omitempty"`
+	// ExpectedStatus is the status a healthy instance answers with; any 2xx
+	// passes when it is 0
+	ExpectedStatus int `bson:"expected_status,omitempty"`
+}
+
+func (hc *HealthCheck) path() string {
+	if hc.Path != "" {
+		return hc.Path
+	}
+	return "/health"
+}
+
+func (hc *HealthCheck) interval() time.Duration {
+	if hc.IntervalMS > 0 {
+		return time.Duration(hc.IntervalMS) * time.Millisecond
+	}
+	return 10 * time.Second
+}
+
+func (hc *HealthCheck) timeout() time.Duration {
+	if hc.TimeoutMS > 0 {
+		return time.Duration(hc.TimeoutMS) * time.Millisecond
+	}
+	return 2 * time.Second
+}
+
+func (hc *HealthCheck) thresholds() (healthy, unhealthy int) {
+	healthy, unhealthy = 2, 3
+	if hc.HealthyThreshold > 0 {
+		healthy = hc.HealthyThreshold
+	}
+	if hc.UnhealthyThreshold > 0 {
+		unhealthy = hc.UnhealthyThreshold
+	}
+	return healthy, unhealthy
+}
+
+func (hc *HealthCheck) passes(status int) bool {
+	if hc.ExpectedStatus != 0 {
+		return status == hc.ExpectedStatus
+	}
+	return status >= 200 && status < 300
+}
+
+type healthKey struct {
+	port int
+	addr string
+}
+
+type instanceHealth struct {
+	healthy bool
+	// streak counts the consecutive checks that disagree with healthy
+	streak  int
+	next    time.Time
+	probing bool
+}
+
+var health = struct {
+	sync.Mutex
+	m map[healthKey]*instanceHealth
+}{m: make(map[healthKey]*instanceHealth)}
+
+// healthTick is how often watchHealth looks for due checks
+const healthTick = time.Second
+
+// watchHealth starts the due checks of every app with a HealthCheck each
+// healthTick, and forgets instances no longer in any app's pool
+func watchHealth() {
+	for now := range time.Tick(healthTick) {
+		type due struct {
+			key   healthKey
+			hc    *HealthCheck
+			proxy *proxyOverride
+		}
+		var checks []due
+		seen := make(map[healthKey]bool)
+		usageData.Lock()
+		for port, app := range usageData.Apps {
+			if app.HealthCheck == nil {
+				continue
+			}
+			for _, in := range appInstances(app, port) {
+				seen[healthKey{port, in.Addr}] = true
+				checks = append(checks, due{healthKey{port, in.Addr}, app.HealthCheck, app.upstreamProxy})
+			}
+		}
+		usageData.Unlock()
+
+		health.Lock()
+		for k := range health.m {
+			if !seen[k] {
+				delete(health.m, k)
+				instanceHealthy.DeleteLabelValues(strconv.Itoa(k.port), k.addr)
+			}
+		}
+		for _, c := range checks {
+			h, ok := health.m[c.key]
+			if !ok {
+				h = &instanceHealth{healthy: true}
+				health.m[c.key] = h
+				instanceHealthy.WithLabelValues(strconv.Itoa(c.key.port), c.key.addr).Set(1)
+			}
+			if h.probing || now.Before(h.next) {
+				continue
+			}
+			h.probing = true
+			// Half a tick early, so a check isn't pushed to the tick after
+			// it is due by timer jitter
+			h.next = now.Add(c.hc.interval() - healthTick/2)
+			go probeInstance(c.key, c.hc, c.proxy)
+		}
+		health.Unlock()
+	}
+}
+
+// probeInstance runs one check and updates the instance's state
+func probeInstance(k healthKey, hc *HealthCheck, proxy *proxyOverride) {
+	err := checkInstance(k.addr, hc, proxy)
+	ok := err == nil
+
+	health.Lock()
+	defer health.Unlock()
+	h, tracked := health.m[k]
+	if !tracked {
+		return
+	}
+	h.probing = false
+	if ok == h.healthy {
+		h.streak = 0
+		return
+	}
+	h.streak++
+	healthyAfter, unhealthyAfter := hc.thresholds()
+	if (ok && h.streak >= healthyAfter) || (!ok && h.streak >= unhealthyAfter) {
+		h.healthy, h.streak = ok, 0
+		e := stateEvent{Kind: "health", App: k.port, Instance: k.addr, From: "healthy", To: "unhealthy"}
+		v := 0.0
+		if ok {
+			e.From, e.To, v = "unhealthy", "healthy", 1
+		} else {
+			e.Error = err.Error()
+		}
+		emitEvent(e)
+		instanceHealthy.WithLabelValues(strconv.Itoa(k.port), k.addr).Set(v)
+	}
+}
+
+// checkInstance runs one check, returning why it failed
+func checkInstance(addr string, hc *HealthCheck, proxy *proxyOverride) error {
+	if isSelf(addr) {
+		return errLoop
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hc.timeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+hc.path(), nil)
+	if err != nil {
+		return err
+	}
+	if proxy != nil {
+		req = withUpstreamProxy(req, proxy.url)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if !hc.passes(resp.StatusCode) {
+		return fmt.Errorf("%s answered %d", hc.path(), resp.StatusCode)
+	}
+	return nil
+}
+
+// healthyInstances leaves out the instances failing the app's health
+// checks. When all of them fail the whole pool is returned, as a broken
+// health endpoint is more likely than every backend being down.
+func healthyInstances(app *App, port int, instances []*Instance) []*Instance {
+	if app == nil || app.HealthCheck == nil {
+		return instances
+	}
+	health.Lock()
+	defer health.Unlock()
+	var up []*Instance
+	for _, in := range instances {
+		if h, ok := health.m[healthKey{port, in.Addr}]; !ok || h.healthy {
+			up = append(up, in)
+		}
+	}
+	if len(up) == 0 {
+		return instances
+	}
+	return up
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	hedgesFired = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_hedges_fired_total",
+		Help: "Hedge requests sent because the primary upstream was slow.",
+	}, []string{"app"})
+	hedgesWon = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_hedges_won_total",
+		Help: "Hedge requests that answered before the primary.",
+	}, []string{"app"})
+)
+
+// hedgeUpstream returns the instance a hedge for t is sent to: the first
+// healthy instance of the app's pool other than the primary.
+// Hedging only applies to body-less GET and HEAD requests of apps with a
+// hedge delay set.
+func hedgeUpstream(t proxyTarget, r *http.Request) (string, bool) {
+	if t.app == nil || t.app.HedgeDelayMS <= 0 {
+		return "", false
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	if r.Body != nil && r.Body != http.NoBody {
+		return "", false
+	}
+	for _, in := range healthyInstances(t.app, t.port, appInstances(t.app, t.port)) {
+		if in.Addr != t.upstream {
+			return in.Addr, true
+		}
+	}
+	return "", false
+}
+
+type hedgeResult struct {
+	resp   *http.Response
+	cancel context.CancelFunc
+	err    error
+	hedge  bool
+}
+
+// sendHedged sends r to the primary upstream and, if it has not answered
+// within the app's hedge delay, once more to hedge. The first successful
+// response wins and the other attempt is canceled. forward only hedges the
+// first attempt, so at most one hedge is sent per request.
+func sendHedged(t proxyTarget, hedge string, r *http.Request) (*http.Response, context.CancelFunc, error) {
+	results := make(chan hedgeResult, 2)
+	launch := func(upstream string, isHedge bool) context.CancelFunc {
+		ctx, cancelBranch := context.WithCancel(r.Context())
+		bt := t
+		bt.upstream = upstream
+		done := func() {}
+		if isHedge {
+			// The primary is already counted by the proxy handler
+			done = trackInstance(upstream)
+		}
+		go func() {
+			resp, cancel, err := sendUpstream(bt, r.WithContext(ctx))
+			results <- hedgeResult{resp, func() { cancel(); cancelBranch(); done() }, err, isHedge}
+		}()
+		return cancelBranch
+	}
+
+	cancelPrimary := launch(t.upstream, false)
+	timer := time.NewTimer(time.Duration(t.app.HedgeDelayMS) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		return res.resp, res.cancel, res.err
+	case <-timer.C:
+	}
+
+	app := strconv.Itoa(t.port)
+	hedgesFired.WithLabelValues(app).Inc()
+	cancelHedge := launch(hedge, true)
+
+	res := <-results
+	pending := 1
+	if res.err != nil {
+		// The other attempt may still succeed
+		res.cancel()
+		res = <-results
+		pending = 0
+	}
+	if pending > 0 {
+		if res.hedge {
+			cancelPrimary()
+		} else {
+			cancelHedge()
+		}
+		go func() {
+			loser := <-results
+			if loser.resp != nil {
+				loser.resp.Body.Close()
+			}
+			loser.cancel()
+		}()
+	}
+	if res.hedge && res.err == nil {
+		hedgesWon.WithLabelValues(app).Inc()
+	}
+	return res.resp, res.cancel, res.err
+}
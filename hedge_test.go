@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedgeSkipsUnhealthyInstances(t *testing.T) {
+	const port = 41170
+	app := &App{
+		HedgeDelayMS: 10,
+		Instances:    []string{"127.0.0.1:41171", "127.0.0.1:41172"},
+		HealthCheck:  &HealthCheck{},
+	}
+	health.Lock()
+	health.m[healthKey{port, "127.0.0.1:41171"}] = &instanceHealth{healthy: false}
+	health.Unlock()
+	t.Cleanup(func() {
+		health.Lock()
+		delete(health.m, healthKey{port, "127.0.0.1:41171"})
+		health.Unlock()
+	})
+
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	got, ok := hedgeUpstream(proxyTarget{port: port, app: app, upstream: "localhost:41170"}, r)
+	if !ok || got != "127.0.0.1:41172" {
+		t.Errorf("hedge = %q, %v, want the healthy 127.0.0.1:41172", got, ok)
+	}
+}
+
+func TestHedgeCountedInFlight(t *testing.T) {
+	var hedgeAddr string
+	var inFlight int64
+	hedgePort := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		inFlight = inFlightTo(hedgeAddr)
+		io.WriteString(w, "hedge")
+	})
+	hedgeAddr = fmt.Sprintf("127.0.0.1:%d", hedgePort)
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "hedge_delay_ms": 20, "instances": [%q]}`, port, hedgeAddr))
+
+	resp, body := get(t, gw, fmt.Sprintf("/%d/", port))
+	if resp.StatusCode != http.StatusOK || body != "hedge" {
+		t.Fatalf("status = %d, body = %q, want the hedge's answer", resp.StatusCode, body)
+	}
+	if inFlight != 1 {
+		t.Errorf("requests in flight to the hedge = %d, want 1", inFlight)
+	}
+	// Released once the gateway is done with the body, which may be just
+	// after the client has read it
+	deadline := time.Now().Add(time.Second)
+	for inFlightTo(hedgeAddr) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := inFlightTo(hedgeAddr); n != 0 {
+		t.Errorf("requests in flight after the response = %d, want 0", n)
+	}
+}
+
+func TestRetriedRequestHedgedOnce(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRIES", "2")
+	t.Setenv("RETRY_BACKOFF", "1ms")
+	var hedges, attempts atomic.Int32
+	hedgePort := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		hedges.Add(1)
+		select {
+		case <-r.Context().Done():
+		case <-time.After(time.Second):
+		}
+	})
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		attempts.Add(1)
+		time.Sleep(50 * time.Millisecond)
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "hedge_delay_ms": 10, "instances": ["127.0.0.1:%d"]}`, port, hedgePort))
+
+	resp, _ := get(t, gw, fmt.Sprintf("/%d/", port))
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("status = %d, want the primary's 502", resp.StatusCode)
+	}
+	if n := attempts.Load(); n != 3 {
+		t.Errorf("primary hit %d times, want 3", n)
+	}
+	if n := hedges.Load(); n != 1 {
+		t.Errorf("%d hedges sent, want 1", n)
+	}
+}
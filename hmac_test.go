@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestMarkSignatureSeen(t *testing.T) {
+	skew := time.Minute
+	start := time.Now()
+	if !markSignatureSeen("a", skew, start) {
+		t.Fatal("first use of a rejected")
+	}
+	if markSignatureSeen("a", skew, start.Add(time.Second)) {
+		t.Error("replay of a accepted")
+	}
+	markSignatureSeen("b", skew, start.Add(time.Minute))
+
+	// a has expired, b is still remembered
+	later := start.Add(2*skew + time.Second)
+	if !markSignatureSeen("a", skew, later) {
+		t.Error("a rejected after it expired")
+	}
+	if markSignatureSeen("b", skew, later) {
+		t.Error("replay of b accepted before it expired")
+	}
+}
+
+func BenchmarkMarkSignatureSeen(b *testing.B) {
+	now := time.Now()
+	for i := 0; i < b.N; i++ {
+		markSignatureSeen(fmt.Sprint("bench-", i), time.Minute, now.Add(time.Duration(i)*time.Millisecond))
+	}
+}
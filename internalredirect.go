@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// errRedirectLoop is returned when a backend's internal redirects revisit a
+// location or chain more than MaxRedirects times
+var errRedirectLoop = errors.New("internal redirect loop")
+
+// InternalRedirect lets the app's backends hand the body of a response off
+// to another location, like nginx's X-Accel-Redirect: a response carrying
+// Header is replaced by a GET (HEAD for HEAD requests) for the path it
+// names, which is streamed to the client instead, headers and all. The
+// client never sees the header.
+type InternalRedirect struct {
+	// Header names the location to serve (default "X-Accel-Redirect"); it
+	// must be a path, optionally with a query
+	Header string `bson:"header,omitempty"`
+	// Upstream (host:port) serves the locations, e.g. a file server; by
+	// default the instance the request was sent to does
+	Upstream string `bson:"upstream,omitempty"`
+	// MaxRedirects bounds how many redirects are followed for a request
+	// (default 3)
+	MaxRedirects int `bson:"max_redirects,omitempty"`
+}
+
+func (ir *InternalRedirect) header() string {
+	if ir.Header != "" {
+		return ir.Header
+	}
+	return "X-Accel-Redirect"
+}
+
+func (ir *InternalRedirect) maxRedirects() int {
+	if ir.MaxRedirects > 0 {
+		return ir.MaxRedirects
+	}
+	return 3
+}
+
+// followInternalRedirects replaces resp, while it names an internal
+// location, by the response for that location. cancel belongs to resp, and
+// the returned cancel to the returned response.
+func followInternalRedirects(t proxyTarget, r *http.Request, resp *http.Response, cancel context.CancelFunc) (*http.Response, context.CancelFunc, error) {
+	if t.app == nil || t.app.InternalRedirect == nil {
+		return resp, cancel, nil
+	}
+	ir := t.app.InternalRedirect
+	upstream := t.upstream
+	if ir.Upstream != "" {
+		upstream = ir.Upstream
+	}
+	seen := make(map[string]bool)
+	for {
+		location := resp.Header.Get(ir.header())
+		if location == "" {
+			return resp, cancel, nil
+		}
+		resp.Body.Close()
+		cancel()
+		if seen[location] || len(seen) >= ir.maxRedirects() {
+			return nil, func() {}, errRedirectLoop
+		}
+		seen[location] = true
+		if !strings.HasPrefix(location, "/") || strings.HasPrefix(location, "//") {
+			return nil, func() {}, fmt.Errorf("internal redirect to %q: not a path", location)
+		}
+		var err error
+		resp, cancel, err = sendInternal(t, r, upstream, location)
+		if err != nil {
+			return nil, cancel, err
+		}
+	}
+}
+
+// sendInternal requests location from upstream on behalf of r, keeping its
+// headers so range and conditional requests still apply
+func sendInternal(t proxyTarget, r *http.Request, upstream, location string) (*http.Response, context.CancelFunc, error) {
+	if isSelf(upstream) {
+		return nil, func() {}, errLoop
+	}
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+	method := http.MethodGet
+	if r.Method == http.MethodHead {
+		method = http.MethodHead
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "http://"+upstream+location, nil)
+	if err != nil {
+		return nil, cancel, err
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Content-Type")
+	setUpstreamHost(t, r, req)
+	if t.app.upstreamProxy != nil {
+		req = withUpstreamProxy(req, t.app.upstreamProxy.url)
+	}
+	resp, err := upstreamClient.Do(req)
+	if err != nil {
+		return nil, cancel, err
+	}
+	return resp, cancel, nil
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IntrospectionConfig configures RFC 7662 token introspection. It is enabled
+// when URL is set.
+type IntrospectionConfig struct {
+	URL          string        // INTROSPECTION_URL
+	ClientID     string        // INTROSPECTION_CLIENT_ID
+	ClientSecret string        // INTROSPECTION_CLIENT_SECRET
+	CacheTTL     time.Duration // INTROSPECTION_CACHE_TTL
+}
+
+type introspectionResult struct {
+	Active bool   `json:"active"`
+	Scope  string `json:"scope"`
+	Sub    string `json:"sub"`
+	Exp    int64  `json:"exp"`
+
+	expires time.Time
+}
+
+// introspectionCache remembers introspection results per token so that every
+// request does not cost a round trip to the identity provider
+type introspectionCache struct {
+	sync.Mutex
+	entries map[string]*introspectionResult
+}
+
+var tokenCache = introspectionCache{
+	entries: make(map[string]*introspectionResult),
+}
+
+var introspectionClient = &http.Client{Timeout: 5 * time.Second}
+
+func (c *introspectionCache) get(token string) (*introspectionResult, bool) {
+	c.Lock()
+	defer c.Unlock()
+	res, ok := c.entries[token]
+	if !ok || time.Now().After(res.expires) {
+		return nil, false
+	}
+	return res, true
+}
+
+func (c *introspectionCache) put(token string, res *introspectionResult) {
+	c.Lock()
+	defer c.Unlock()
+	now := time.Now()
+	// Drop expired entries now and then so revoked tokens don't pile up
+	if len(c.entries) >= 10000 {
+		for t, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, t)
+			}
+		}
+	}
+	c.entries[token] = res
+}
+
+func introspect(cfg IntrospectionConfig, token string) (*introspectionResult, error) {
+	if res, ok := tokenCache.get(token); ok {
+		return res, nil
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if cfg.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(cfg.ClientID), url.QueryEscape(cfg.ClientSecret))
+	}
+
+	resp, err := introspectionClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection endpoint returned %s", resp.Status)
+	}
+
+	var res introspectionResult
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	res.expires = time.Now().Add(cfg.CacheTTL)
+	// Never cache an active token past its own expiry
+	if res.Exp > 0 {
+		if exp := time.Unix(res.Exp, 0); exp.Before(res.expires) {
+			res.expires = exp
+		}
+	}
+	tokenCache.put(token, &res)
+	return &res, nil
+}
+
+// introspectionAuth accepts requests with a bearer token the introspection
+// endpoint reports as active. The token's scope and subject are forwarded to
+// the backend.
+type introspectionAuth struct {
+	cfg IntrospectionConfig
+}
+
+func (a introspectionAuth) Authenticate(r *http.Request) (Principal, error) {
+	token, ok := bearerToken(r)
+	if !ok {
+		return Principal{}, unauthorized("Missing bearer token", "Bearer")
+	}
+	res, err := introspect(a.cfg, token)
+	if err != nil {
+		log.Printf("Error introspecting token: %v", err)
+		return Principal{}, &authError{status: http.StatusServiceUnavailable, msg: "Token introspection unavailable"}
+	}
+	if !res.Active {
+		return Principal{}, unauthorized("Inactive token", `Bearer error="invalid_token"`)
+	}
+	return Principal{Subject: res.Sub, Scope: res.Scope}, nil
+}
+
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return "", false
+	}
+	return strings.TrimSpace(token), true
+}
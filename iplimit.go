@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var ipLimitRejected = promauto.NewCounter(prometheus.CounterOpts{
+	Name: "gateway_ip_limit_rejected_total",
+	Help: "Proxied requests rejected because their client IP had MAX_REQUESTS_PER_IP in flight.",
+})
+
+// ipLimiter counts the requests in flight per client IP. IPs are dropped
+// when their last request is done, so the map only holds active clients.
+type ipLimiter struct {
+	mu     sync.Mutex
+	active map[string]int
+}
+
+// limitPerIP answers 429 to requests from a client IP (see clientIP) that
+// already has limit requests in flight, unless it is in allow. Unlike rate
+// limiting this bounds concurrency, so a single host can't tie up the
+// gateway with many slow requests.
+func limitPerIP(limit int, allow []*net.IPNet) func(http.Handler) http.Handler {
+	l := &ipLimiter{active: make(map[string]int)}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			if inNets(ip, allow) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !l.acquire(ip, limit) {
+				ipLimitRejected.Inc()
+				countShed(0, shedIPLimit)
+				http.Error(w, "Too many concurrent requests from this client", http.StatusTooManyRequests)
+				return
+			}
+			defer l.release(ip)
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+func (l *ipLimiter) acquire(ip string, limit int) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip] >= limit {
+		return false
+	}
+	l.active[ip]++
+	return true
+}
+
+func (l *ipLimiter) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active[ip]--; l.active[ip] <= 0 {
+		delete(l.active, ip)
+	}
+}
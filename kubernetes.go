@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// KubernetesDiscovery fills the app's instances with the ready endpoints of a
+// Kubernetes Service, using the in-cluster service account
+type KubernetesDiscovery struct {
+	Namespace string `bson:"namespace"`
+	Service   string `bson:"service"`
+	// PortName picks the endpoint port by name; empty takes the first one
+	PortName string `bson:"port_name,omitempty"`
+}
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// The subset of the discovery.k8s.io/v1 EndpointSlice used here
+type endpointSlice struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Endpoints []struct {
+		Addresses  []string `json:"addresses"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+	Ports []struct {
+		Name *string `json:"name"`
+		Port *int32  `json:"port"`
+	} `json:"ports"`
+}
+
+type endpointSliceList struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Items []endpointSlice `json:"items"`
+}
+
+type kubeClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+func newKubeClient() (*kubeClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running inside a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s/ca.crt", serviceAccountDir)
+	}
+	return &kubeClient{
+		base:  "https://" + net.JoinHostPort(host, port),
+		token: string(token),
+		http: &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		}},
+	}, nil
+}
+
+func (c *kubeClient) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.base+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("kubernetes API returned %s", resp.Status)
+	}
+	return resp, nil
+}
+
+// readyInstances lists the host:port of every ready endpoint of the service
+func (c *kubeClient) readyInstances(ctx context.Context, kd KubernetesDiscovery) ([]*Instance, string, error) {
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(kd.Namespace))
+	resp, err := c.get(ctx, path, url.Values{"labelSelector": {"kubernetes.io/service-name=" + kd.Service}})
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var list endpointSliceList
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, "", err
+	}
+	var instances []*Instance
+	for _, slice := range list.Items {
+		port, ok := slicePort(slice, kd.PortName)
+		if !ok {
+			continue
+		}
+		for _, ep := range slice.Endpoints {
+			// A nil ready condition means ready, per the EndpointSlice API
+			if ep.Conditions.Ready != nil && !*ep.Conditions.Ready {
+				continue
+			}
+			for _, addr := range ep.Addresses {
+				instances = append(instances, &Instance{Addr: net.JoinHostPort(addr, strconv.Itoa(port))})
+			}
+		}
+	}
+	return instances, list.Metadata.ResourceVersion, nil
+}
+
+func slicePort(slice endpointSlice, name string) (int, bool) {
+	for _, p := range slice.Ports {
+		if p.Port == nil {
+			continue
+		}
+		if name == "" || (p.Name != nil && *p.Name == name) {
+			return int(*p.Port), true
+		}
+	}
+	return 0, false
+}
+
+// waitForChange blocks on a watch of the service's EndpointSlices until any
+// event arrives or the watch ends
+func (c *kubeClient) waitForChange(ctx context.Context, kd KubernetesDiscovery, resourceVersion string) error {
+	path := fmt.Sprintf("/apis/discovery.k8s.io/v1/namespaces/%s/endpointslices", url.PathEscape(kd.Namespace))
+	resp, err := c.get(ctx, path, url.Values{
+		"labelSelector":   {"kubernetes.io/service-name=" + kd.Service},
+		"watch":           {"true"},
+		"resourceVersion": {resourceVersion},
+		"timeoutSeconds":  {"300"},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Every event means the endpoint set may have changed; the caller relists
+	// rather than applying events one by one
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	if scanner.Scan() {
+		return nil
+	}
+	return scanner.Err()
+}
+
+// watchKubernetes keeps the app's discovered instances in sync with the
+// service's ready endpoints until ctx is done
+func watchKubernetes(ctx context.Context, port int, kd KubernetesDiscovery) {
+	client, err := newKubeClient()
+	if err != nil {
+		log.Printf("Kubernetes discovery for app %d disabled: %v", port, err)
+		return
+	}
+	backoff := time.Second
+	for ctx.Err() == nil {
+		instances, rv, err := client.readyInstances(ctx, kd)
+		if err == nil {
+			setDiscovered(port, instances)
+			err = client.waitForChange(ctx, kd, rv)
+		}
+		if err == nil {
+			backoff = time.Second
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		// Keep routing to the last known instances while the API is unreachable
+		log.Printf("Kubernetes discovery for app %d: %v", port, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return
+		}
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
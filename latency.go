@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The latency histograms take their buckets from the config, so they are
+// registered by the first NewServer
+var (
+	upstreamFirstByte *prometheus.HistogramVec
+	upstreamLastByte  *prometheus.HistogramVec
+	latencyMetrics    sync.Once
+)
+
+// registerLatencyMetrics creates the upstream latency histograms with the
+// buckets from UPSTREAM_LATENCY_BUCKETS. Time to last byte is only tracked
+// with UPSTREAM_LATENCY_LAST_BYTE, as it needs every body wrapped.
+func registerLatencyMetrics() {
+	latencyMetrics.Do(newLatencyMetrics)
+}
+
+func newLatencyMetrics() {
+	upstreamFirstByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_upstream_first_byte_seconds",
+		Help:    "Time from sending a request upstream to receiving the response headers, per app.",
+		Buckets: config.LatencyBuckets,
+	}, []string{"app"})
+	if config.LatencyLastByte {
+		upstreamLastByte = promauto.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "gateway_upstream_last_byte_seconds",
+			Help:    "Time from sending a request upstream to reading the end of the response body, per app.",
+			Buckets: config.LatencyBuckets,
+		}, []string{"app"})
+	}
+}
+
+// observeLatency records the time to first byte of resp, sent at start, and
+// wraps its body to record the time to last byte when that is enabled
+func observeLatency(port int, start time.Time, resp *http.Response) {
+	if upstreamFirstByte == nil {
+		return
+	}
+	label := strconv.Itoa(port)
+	upstreamFirstByte.WithLabelValues(label).Observe(time.Since(start).Seconds())
+	if upstreamLastByte != nil {
+		resp.Body = &timedBody{ReadCloser: resp.Body, start: start, observer: upstreamLastByte.WithLabelValues(label)}
+	}
+}
+
+// timedBody observes the elapsed time once the body is read to the end or
+// closed, whichever comes first
+type timedBody struct {
+	io.ReadCloser
+	start    time.Time
+	observer prometheus.Observer
+	once     sync.Once
+}
+
+func (b *timedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.observe()
+	}
+	return n, err
+}
+
+func (b *timedBody) Close() error {
+	b.observe()
+	return b.ReadCloser.Close()
+}
+
+func (b *timedBody) observe() {
+	b.once.Do(func() { b.observer.Observe(time.Since(b.start).Seconds()) })
+}
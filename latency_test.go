@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestLatencyMetricsRegistered(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	gw := startGateway(t, appDoc(port))
+
+	get(t, gw, fmt.Sprintf("/%d/", port))
+	_, body := get(t, gw, "/metrics")
+	want := fmt.Sprintf(`gateway_upstream_first_byte_seconds_count{app="%d"} 1`, port)
+	if !strings.Contains(body, want) {
+		t.Errorf("/metrics lacks %s", want)
+	}
+}
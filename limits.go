@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// RouteLimit overrides the app's limits for requests whose path (relative to
+// the app, e.g. "/upload/avatar") matches Path. A trailing "*" makes Path a
+// prefix match; otherwise the path must match exactly.
+type RouteLimit struct {
+	Path        string `bson:"path"`
+	TimeoutMS   int64  `bson:"timeout_ms,omitempty"`
+	MaxBodySize int64  `bson:"max_body_size,omitempty"`
+}
+
+func (rl RouteLimit) matches(p string) bool {
+	return matchPath(rl.Path, p)
+}
+
+// matchPath matches p against pattern, which is a prefix when it ends in "*"
+// and exact otherwise
+func matchPath(pattern, p string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(p, prefix)
+	}
+	return p == pattern
+}
+
+// requestLimits resolves the upstream timeout and body-size limit for a
+// request. Precedence is: first matching route override > app > global
+// default. A zero value at any level means "not set" and falls through.
+func requestLimits(app *App, p string) (timeout time.Duration, maxBody int64) {
+	timeout, maxBody = config.UpstreamTimeout, config.MaxBodySize
+	if app == nil {
+		return timeout, maxBody
+	}
+	if app.TimeoutMS > 0 {
+		timeout = time.Duration(app.TimeoutMS) * time.Millisecond
+	}
+	if app.MaxBodySize > 0 {
+		maxBody = app.MaxBodySize
+	}
+	for _, rl := range app.Routes {
+		if !rl.matches(p) {
+			continue
+		}
+		if rl.TimeoutMS > 0 {
+			timeout = time.Duration(rl.TimeoutMS) * time.Millisecond
+		}
+		if rl.MaxBodySize > 0 {
+			maxBody = rl.MaxBodySize
+		}
+		break
+	}
+	return timeout, maxBody
+}
@@ -0,0 +1,51 @@
+package main
+
+import "net"
+
+// limitListener caps the number of open client connections. Unlike
+// netutil.LimitListener, which stops accepting and leaves clients waiting in
+// the kernel backlog, connections over the cap are accepted and closed right
+// away so clients fail fast.
+//
+// Idle keep-alive connections count against the cap, so the proxy server's
+// IdleTimeout (IDLE_TIMEOUT) should be short enough to hand slots back to new
+// clients when the limit is tight.
+type limitListener struct {
+	net.Listener
+	sem chan struct{}
+}
+
+func newLimitListener(l net.Listener, n int) net.Listener {
+	return &limitListener{Listener: l, sem: make(chan struct{}, n)}
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.sem <- struct{}{}:
+			listenerConnections.Inc()
+			return &trackedConn{Conn: c, gauge: listenerConnections, release: func() { <-l.sem }}, nil
+		default:
+			listenerRejected.Inc()
+			c.Close()
+		}
+	}
+}
+
+// countListener only tracks open client connections, for when no cap is set
+type countListener struct {
+	net.Listener
+}
+
+func (l countListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	listenerConnections.Inc()
+	return &trackedConn{Conn: c, gauge: listenerConnections}, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LocationRewrite rewrites Location and Content-Location headers that point
+// at the app's own backends, so redirects don't send clients to internal
+// addresses. URLs on any other host are left alone.
+type LocationRewrite struct {
+	// BaseURL is the gateway's external URL for the app, e.g.
+	// "https://api.example.com". When empty, internal URLs are made
+	// root-relative and resolve against whatever host the client used.
+	BaseURL string `bson:"base_url,omitempty"`
+	// Hosts are further host:port pairs the backends call themselves, on
+	// top of the app's instances and localhost:<port>
+	Hosts []string `bson:"hosts,omitempty"`
+}
+
+// rewriteLocations applies the app's LocationRewrite to resp's headers
+func rewriteLocations(t proxyTarget, resp *http.Response) {
+	if t.app == nil || t.app.LocationRewrite == nil {
+		return
+	}
+	lr := t.app.LocationRewrite
+	base, err := url.Parse(lr.BaseURL)
+	if err != nil {
+		return
+	}
+	for _, key := range []string{"Location", "Content-Location"} {
+		v := resp.Header.Get(key)
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil {
+			continue
+		}
+		switch {
+		case u.Host != "":
+			if !lr.internal(t, u.Host) {
+				continue
+			}
+		case strings.HasPrefix(u.Path, "/"):
+			// Already resolves against the gateway, only the base path is
+			// missing
+		default:
+			// Relative to the request path, which the gateway keeps
+			continue
+		}
+		u.Scheme, u.Host, u.User = base.Scheme, base.Host, nil
+		u.Path = strings.TrimSuffix(base.Path, "/") + u.Path
+		if u.RawPath != "" {
+			u.RawPath = strings.TrimSuffix(base.EscapedPath(), "/") + u.RawPath
+		}
+		resp.Header.Set(key, u.String())
+	}
+}
+
+// internal reports whether host is one of the app's backends
+func (lr *LocationRewrite) internal(t proxyTarget, host string) bool {
+	port := strconv.Itoa(t.port)
+	hosts := append([]string{t.upstream, "localhost:" + port, "127.0.0.1:" + port}, lr.Hosts...)
+	for _, in := range appInstances(t.app, t.port) {
+		hosts = append(hosts, in.Addr)
+	}
+	for _, h := range hosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
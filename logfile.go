@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// openLogFile sends the gateway's logs to config.LogFile, rotating it once
+// it reaches LOG_MAX_SIZE megabytes and, with LOG_ROTATE_INTERVAL set, on
+// that schedule. Old files beyond LOG_MAX_BACKUPS or LOG_MAX_AGE days are
+// removed. The logger serializes writes, so concurrent requests can log
+// safely across a rotation.
+func openLogFile() {
+	out := &lumberjack.Logger{
+		Filename:   config.LogFile,
+		MaxSize:    config.LogMaxSizeMB,
+		MaxBackups: config.LogMaxBackups,
+		MaxAge:     config.LogMaxAgeDays,
+		Compress:   config.LogCompress,
+	}
+	log.SetOutput(out)
+
+	if config.LogRotateInterval > 0 {
+		go func() {
+			for range time.Tick(config.LogRotateInterval) {
+				if err := out.Rotate(); err != nil {
+					log.Printf("Error rotating log file: %v", err)
+				}
+			}
+		}()
+	}
+}
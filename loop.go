@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// errLoop is returned for requests the gateway would send to itself
+var errLoop = errors.New("upstream is the gateway itself")
+
+// viaToken identifies this gateway in Via headers (VIA_TOKEN)
+var viaToken string
+
+// selfHosts are the names and addresses the gateway can be reached at
+var selfHosts map[string]bool
+
+// setupLoopDetection works out the gateway's own addresses and Via token
+func setupLoopDetection() {
+	selfHosts = map[string]bool{"localhost": true, "": true}
+	hostname, err := os.Hostname()
+	if err == nil {
+		selfHosts[strings.ToLower(hostname)] = true
+	} else {
+		hostname = "gateway"
+	}
+	if addrs, err := net.InterfaceAddrs(); err == nil {
+		for _, a := range addrs {
+			if n, ok := a.(*net.IPNet); ok {
+				selfHosts[n.IP.String()] = true
+			}
+		}
+	}
+	viaToken = config.ViaToken
+	if viaToken == "" {
+		viaToken = hostname
+		if config.AppPort != "" {
+			viaToken += ":" + config.AppPort
+		}
+	}
+}
+
+// isSelf reports whether the upstream host:port is the gateway's own
+// listener, which would make the request loop until the process falls over
+func isSelf(upstream string) bool {
+	host, port, err := net.SplitHostPort(upstream)
+	if err != nil || (port != config.AppPort && port != config.AdminPort) {
+		return false
+	}
+	host = strings.ToLower(strings.Trim(host, "[]"))
+	if ip := net.ParseIP(host); ip != nil {
+		if ip.IsLoopback() || ip.IsUnspecified() {
+			return true
+		}
+		host = ip.String()
+	}
+	return selfHosts[host]
+}
+
+// seenVia reports whether this gateway already forwarded the request, as
+// shown by its token in the Via header
+func seenVia(h http.Header) bool {
+	for _, v := range h.Values("Via") {
+		for _, hop := range strings.Split(v, ",") {
+			// Each hop is "protocol received-by [comment]"
+			fields := strings.Fields(hop)
+			if len(fields) >= 2 && strings.EqualFold(fields[1], viaToken) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// addVia appends this gateway to the request's Via header
+func addVia(r *http.Request) {
+	r.Header.Add("Via", viaHop(r.ProtoMajor, r.ProtoMinor))
+}
+
+// viaHop is the Via entry for a message this gateway received with the
+// given HTTP version
+func viaHop(major, minor int) string {
+	return strconv.Itoa(major) + "." + strconv.Itoa(minor) + " " + viaToken
+}
+
+// detectLoops rejects requests that have already passed through this
+// gateway with 508 Loop Detected
+func detectLoops(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if seenVia(r.Header) {
+			jsonError(w, http.StatusLoopDetected, "Request loop detected")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -1,31 +1,139 @@
 package main
 
 import (
-	"context"
-	"fmt"
-	"io"
+	"flag"
 	"log"
-	"os"
+	"net"
 	"net/http"
-	"strconv"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/joho/godotenv"
-	"github.com/go-chi/chi/v5"
-	"github.com/go-chi/chi/v5/middleware"
-	"go.mongodb.org/mongo-driver/bson"
-	"go.mongodb.org/mongo-driver/mongo"
-	"go.mongodb.org/mongo-driver/mongo/options"
 )
 
 // App represents a backend application with its usage count
 type App struct {
 	Port  int `bson:"port"`
 	Count int `bson:"count"`
+
+	// Optional hard limit on requests per quota cycle (see cycleStart);
+	// CycleCount is the usage within the cycle that began at CycleStart
+	Quota      int       `bson:"quota,omitempty"`
+	CycleCount int       `bson:"cycle_count"`
+	CycleStart time.Time `bson:"cycle_start"`
+
+	// Body bytes received from and sent to clients, for bandwidth billing
+	BytesIn  int64 `bson:"bytes_in"`
+	BytesOut int64 `bson:"bytes_out"`
+
+	// Optional overrides of the global UPSTREAM_TIMEOUT / MAX_BODY_SIZE,
+	// see requestLimits for precedence
+	TimeoutMS   int64        `bson:"timeout_ms,omitempty"`
+	MaxBodySize int64        `bson:"max_body_size,omitempty"`
+	Routes      []RouteLimit `bson:"routes,omitempty"`
+
+	// Optional content-type based instance selection, see selectUpstream
+	ContentRoutes []ContentRoute `bson:"content_routes,omitempty"`
+	// Optional header-based API version routing
+	VersionRouting *VersionRouting `bson:"version_routing,omitempty"`
+
+	// Instances are further backends serving the app besides the default
+	// one on localhost:<port>; requests are spread over all of them
+	Instances []string `bson:"instances,omitempty"`
+	// Discovery, when set, replaces the static instances with ones found by
+	// service discovery
+	Discovery *Discovery `bson:"discovery,omitempty"`
+	// LoadBalancing picks how requests are spread over the instances
+	LoadBalancing *LoadBalancing `bson:"load_balancing,omitempty"`
+	balancer      Balancer
+	// HedgeDelayMS, when set, sends a second GET to another instance if the
+	// first has not answered within this many milliseconds
+	HedgeDelayMS int64 `bson:"hedge_delay_ms,omitempty"`
+	// HealthCheck probes the instances and leaves failing ones out
+	HealthCheck *HealthCheck `bson:"health_check,omitempty"`
+	// Circuit overrides the global circuit breaker settings
+	Circuit *CircuitBreaker `bson:"circuit,omitempty"`
+
+	// InternalRedirect lets backends delegate a response to another
+	// location, e.g. a large file
+	InternalRedirect *InternalRedirect `bson:"internal_redirect,omitempty"`
+
+	// Streaming relays every response chunk as soon as it arrives instead of
+	// coalescing them (see copyResponse); event streams always are
+	Streaming bool `bson:"streaming,omitempty"`
+
+	// UpstreamProxy is a forward proxy URL (http, https or socks5) the app's
+	// backends are reached through instead of HTTP_PROXY/HTTPS_PROXY, or
+	// "direct" to bypass those
+	UpstreamProxy string `bson:"upstream_proxy,omitempty"`
+	upstreamProxy *proxyOverride
+
+	// The Host header sent to the app's backends is the client's, like
+	// other reverse proxies send. UpstreamHost, when set, replaces it
+	// whichever address they are dialed at, for backends that route by
+	// virtual host; DialHost sends the address dialed instead, e.g.
+	// "localhost:8080".
+	UpstreamHost string `bson:"upstream_host,omitempty"`
+	DialHost     bool   `bson:"dial_host,omitempty"`
+
+	// DisableKeepAlives uses a fresh upstream connection per request, for
+	// backends that misbehave when connections are reused
+	DisableKeepAlives bool `bson:"disable_keep_alives,omitempty"`
+
+	// MaxConcurrent bounds the requests in flight to the app (0 = no limit)
+	MaxConcurrent int `bson:"max_concurrent,omitempty"`
+	// Queue lets requests over MaxConcurrent wait for a slot by priority
+	Queue *PriorityQueueing `bson:"queue,omitempty"`
+	// RateLimit throttles the app's requests, weighted by cost
+	RateLimit *RateLimit `bson:"rate_limit,omitempty"`
+	// Auth names the authentication schemes the app's requests must all
+	// pass ("api_key", "hmac", "introspection", or "none" for an open app),
+	// replacing the globally enabled ones
+	Auth           []string `bson:"auth,omitempty"`
+	authenticators []Authenticator
+	// CSRF requires double-submit tokens on unsafe requests
+	CSRF *CSRFProtection `bson:"csrf,omitempty"`
+	// BlueGreen replaces the instances with two pools switched via the admin API
+	BlueGreen *BlueGreen `bson:"blue_green,omitempty"`
+	// ShadowCompare checks a second backend's responses against the primary's
+	ShadowCompare *ShadowCompare `bson:"shadow_compare,omitempty"`
+	// Experiment assigns clients to A/B variant backends
+	Experiment *Experiment `bson:"experiment,omitempty"`
+	// GeoRouting sends requests to instances by client country
+	GeoRouting *GeoRouting `bson:"geo_routing,omitempty"`
+	// LogSampleRate logs 1 in N of the app's successful requests,
+	// overriding LOG_SAMPLE_RATE (0 = use the global rate)
+	LogSampleRate int `bson:"log_sample_rate,omitempty"`
+	// BodyLogging logs a sample of the app's bodies, with secrets masked
+	BodyLogging *BodyLogging `bson:"body_logging,omitempty"`
+
+	// CookieRewrite rewrites the Domain and Path of upstream cookies
+	CookieRewrite *CookieRewrite `bson:"cookie_rewrite,omitempty"`
+	// LocationRewrite points redirects at the gateway instead of a backend
+	LocationRewrite *LocationRewrite `bson:"location_rewrite,omitempty"`
+
+	// ResponseRewrites are applied in order to text response bodies
+	ResponseRewrites []RewriteRule `bson:"response_rewrites,omitempty"`
+	responseRewrites []compiledRewrite
+
+	// RequestFields are set on JSON object request bodies before forwarding,
+	// e.g. a tenant ID the client must not control. Values should be scalars
+	// or arrays.
+	RequestFields map[string]interface{} `bson:"request_fields,omitempty"`
+
+	// CacheTTLMS enables caching of the app's GET responses for up to this
+	// many milliseconds (less if the upstream's max-age says so)
+	CacheTTLMS int64 `bson:"cache_ttl_ms,omitempty"`
+
+	// ErrorPages replaces upstream error bodies with the pages from
+	// ERROR_PAGES_DIR; when false they are passed through unchanged
+	ErrorPages bool `bson:"error_pages,omitempty"`
 }
 
-// UsageData stores usage counts of all apps
+// UsageData stores usage counts of all apps. Apps, and the counters of the
+// apps in it, may only be read or written with the lock held; the map is
+// written to at runtime (AUTO_REGISTER, blue-green switches).
 type UsageData struct {
 	sync.Mutex
 	Apps map[int]*App
@@ -36,6 +144,16 @@ var usageData = UsageData{
 }
 
 func main() {
+	os.Exit(run())
+}
+
+// run starts the gateway and serves until it is told to stop, returning the
+// exit code. Once the PID file is written failures are returned rather than
+// fatal, so the deferred cleanup still runs.
+func run() int {
+	validate := flag.Bool("validate", false, "check the configuration and exit")
+	appsFile := flag.String("apps", "", "with -validate, also check the apps in this mongoexport dump")
+	flag.Parse()
 
 	// Load environment variables from .env file
 	err := godotenv.Load()
@@ -48,109 +166,89 @@ func main() {
 	mongoDatabase := os.Getenv("MONGO_DATABASE")
 	mongoCollection := os.Getenv("MONGO_COLLECTION")
 
-	appPort := os.Getenv("APP_PORT")
+	config = loadConfig()
+	if *validate {
+		return runValidate(*appsFile)
+	}
 
-	// Connect to MongoDB
-	clientOpts := options.Client().ApplyURI(mongoURI)
-	client, err := mongo.NewClient(clientOpts)
-	if err != nil {
-		log.Fatalf("Error creating MongoDB client: %v", err)
+	if config.LogFile != "" {
+		openLogFile()
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
-	err = client.Connect(ctx)
-	if err != nil {
-		log.Fatalf("Error connecting to MongoDB: %v", err)
+	if config.OTLPEndpoint != "" {
+		go exportOTLPLogs(config.OTLPEndpoint)
 	}
-	defer func() {
-		if err := client.Disconnect(ctx); err != nil {
-			log.Fatalf("Error disconnecting from MongoDB: %v", err)
+	if config.PIDFile != "" {
+		if err := writePIDFile(config.PIDFile); err != nil {
+			log.Fatalf("Error writing PID file: %v", err)
 		}
-	}()
-
-	// Retrieve existing counts from MongoDB
-	collection := client.Database(mongoDatabase).Collection(mongoCollection)
-	cursor, err := collection.Find(ctx, bson.M{})
-	if err != nil {
-		log.Fatalf("Error retrieving counts from MongoDB: %v", err)
+		defer removePIDFile(config.PIDFile)
 	}
-	defer cursor.Close(ctx)
 
-	for cursor.Next(ctx) {
-		var app App
-		if err := cursor.Decode(&app); err != nil {
-			log.Printf("Error decoding app from MongoDB: %v", err)
-			continue
+	var store UsageStore
+	if config.Storage == "memory" {
+		log.Printf("Using in-memory storage; usage counts are lost on restart")
+		store = newMemoryStore(config.AppsFile)
+	} else {
+		ms, disconnect, err := newMongoStore(mongoURI, mongoDatabase, mongoCollection)
+		if err != nil {
+			log.Printf("Error connecting to MongoDB: %v", err)
+			return 1
 		}
-		usageData.Lock()
-		usageData.Apps[app.Port] = &app
-		usageData.Unlock()
+		defer disconnect()
+		store = ms
 	}
 
-	if err := cursor.Err(); err != nil {
-		log.Fatalf("Cursor error: %v", err)
+	server, err := NewServer(config, store)
+	if err != nil {
+		log.Printf("Error setting up server: %v", err)
+		return 1
 	}
-
-	// Set up the router
-	r := chi.NewRouter()
-	r.Use(middleware.Logger)
-
-	// Proxy routes to backend applications
-	r.HandleFunc("/{appID}", func(w http.ResponseWriter, r *http.Request) {
-		appID := chi.URLParam(r, "appID")
-		port, err := strconv.Atoi(appID)
+	go watchAppReloads(store, config.AppsReloadInterval)
+	go watchStore(store, config.StoreHealthInterval)
+	go watchHealth()
+	go watchUsage(store, config.UsageFlushInterval)
+	go watchTenantUsage(store, config.TenantFlushInterval)
+	if config.UsageHistory {
+		go watchUsageHistory(store)
+	}
+	if admin := server.AdminHandler(); admin != nil {
+		// Listening first, so a port in use fails startup
+		adminLn, err := net.Listen("tcp", ":"+config.AdminPort)
 		if err != nil {
-			http.Error(w, "Invalid application ID", http.StatusBadRequest)
-			return
+			log.Printf("Error listening on admin port %s: %v", config.AdminPort, err)
+			return 1
 		}
-
-		proxyRequest(port, w, r)
-
-		// Increment usage count
-		usageData.Lock()
-		if app, ok := usageData.Apps[port]; ok {
-			app.Count++
-			// Update count in MongoDB
-			filter := bson.M{"port": port}
-			update := bson.M{"$set": bson.M{"count": app.Count}}
-
-			updateCtx, updateCancel := context.WithTimeout(context.Background(), 20*time.Second)
-			defer updateCancel()
-			_, err := collection.UpdateOne(updateCtx, filter, update)
-			if err != nil {
-				log.Printf("Error updating MongoDB count for port %d: %v", port, err)
+		go func() {
+			log.Printf("Starting admin server on port %s", config.AdminPort)
+			if err := http.Serve(adminLn, admin); err != nil {
+				log.Printf("Admin server error: %v", err)
 			}
-		} else {
-			log.Printf("App for port %d not found", port)
-		}
-		usageData.Unlock()
-	})
-
-	log.Printf("Starting server on port %s", appPort)
-	http.ListenAndServe(":"+appPort, r)
-}
-
-func proxyRequest(port int, w http.ResponseWriter, r *http.Request) {
-	proxyURL := fmt.Sprintf("http://localhost:%d%s", port, r.URL.Path)
-	req, err := http.NewRequest(r.Method, proxyURL, r.Body)
-	if err != nil {
-		http.Error(w, "Error creating request", http.StatusInternalServerError)
-		return
+		}()
 	}
-	req.Header = r.Header
 
-	resp, err := http.DefaultClient.Do(req)
+	ln, err := net.Listen("tcp", ":"+config.AppPort)
 	if err != nil {
-		http.Error(w, "Error forwarding request", http.StatusInternalServerError)
-		return
+		log.Printf("Error listening on port %s: %v", config.AppPort, err)
+		return 1
 	}
-	defer resp.Body.Close()
+	if config.MaxConnections > 0 {
+		ln = newLimitListener(ln, config.MaxConnections)
+	} else {
+		ln = countListener{ln}
+	}
+	srv := &http.Server{Handler: server, IdleTimeout: config.IdleTimeout}
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	log.Printf("Starting server on port %s", config.AppPort)
+	code := 0
+	if err := serveUntilSignal(srv, ln, config.ShutdownTimeout); err != nil {
+		log.Printf("Server error: %v", err)
+		code = 1
+	}
+	flushUsage(store)
+	flushTenantUsage(store)
+	if config.UsageHistory {
+		// What was gathered since the last flush
+		flushHistory(store)
 	}
-	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	return code
 }
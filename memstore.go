@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps everything in-process (STORAGE=memory), for running the
+// gateway without MongoDB. Apps come from APPS_FILE and AUTO_REGISTER; usage
+// and minted API keys are lost on restart.
+type memoryStore struct {
+	appsFile string
+
+	mu         sync.Mutex
+	registered map[int]bool
+	active     map[int]string
+	keys       map[string]*APIKey
+}
+
+func newMemoryStore(appsFile string) *memoryStore {
+	return &memoryStore{
+		appsFile:   appsFile,
+		registered: make(map[int]bool),
+		active:     make(map[int]string),
+		keys:       make(map[string]*APIKey),
+	}
+}
+
+// LoadApps re-reads APPS_FILE each time, so editing it and reloading works
+// like it does with MongoDB
+func (s *memoryStore) LoadApps(ctx context.Context) (map[int]*App, error) {
+	apps := make(map[int]*App)
+	if s.appsFile != "" {
+		read, errs := readAppsFile(s.appsFile)
+		for _, err := range errs {
+			log.Printf("Error reading apps file: %v", err)
+		}
+		for _, app := range read {
+			apps[app.Port] = app
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for port := range s.registered {
+		if _, ok := apps[port]; !ok {
+			apps[port] = &App{Port: port}
+		}
+	}
+	for _, app := range apps {
+		if color, ok := s.active[app.Port]; ok && app.BlueGreen != nil {
+			app.BlueGreen.Active = color
+		}
+		app.prepare()
+	}
+	return apps, nil
+}
+
+func (s *memoryStore) RegisterApp(ctx context.Context, port int) error {
+	s.mu.Lock()
+	s.registered[port] = true
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) AddUsage(ctx context.Context, deltas []*UsageDelta) error {
+	return nil
+}
+
+// LoadTenantUsage returns nothing, as tenant usage already lives in memory
+func (s *memoryStore) LoadTenantUsage(ctx context.Context) ([]*TenantUsage, error) {
+	return nil, nil
+}
+
+func (s *memoryStore) SaveTenantUsage(ctx context.Context, u *TenantUsage) error {
+	return nil
+}
+
+// AddUsageHistory drops the buckets; there is nothing to roll them up with
+func (s *memoryStore) AddUsageHistory(ctx context.Context, buckets []*UsageBucket) error {
+	return nil
+}
+
+func (s *memoryStore) Rollup(ctx context.Context, q RollupQuery, emit func(row map[string]any) error) error {
+	return errRollupUnsupported
+}
+
+func (s *memoryStore) SetActivePool(ctx context.Context, port int, color string) error {
+	s.mu.Lock()
+	s.active[port] = color
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) LoadAPIKeys(ctx context.Context) (map[string]*APIKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make(map[string]*APIKey, len(s.keys))
+	for k, v := range s.keys {
+		keys[k] = v
+	}
+	return keys, nil
+}
+
+func (s *memoryStore) InsertAPIKey(ctx context.Context, key *APIKey) error {
+	s.mu.Lock()
+	s.keys[key.Key] = key
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *memoryStore) ExpireAPIKeys(ctx context.Context, principal, keep string, cutoff time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k, v := range s.keys {
+		if v.Principal == principal && k != keep && (v.ExpiresAt.IsZero() || v.ExpiresAt.After(cutoff)) {
+			// Keys are shared with in-flight requests, so replace rather than mutate
+			expiring := *v
+			expiring.ExpiresAt = cutoff
+			s.keys[k] = &expiring
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) DeleteAPIKey(ctx context.Context, key string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.keys[key]
+	delete(s.keys, key)
+	return ok, nil
+}
+
+func (s *memoryStore) Ping(ctx context.Context) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// webDAVMethods are forwarded besides the standard methods
+var webDAVMethods = []string{"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "LOCK", "UNLOCK", "REPORT", "SEARCH"}
+
+// standardMethods are the methods of RFC 9110 and PATCH
+var standardMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
+
+// allowedMethods lists the methods the route r was made to has handlers for
+func allowedMethods(r *http.Request) []string {
+	rctx := chi.RouteContext(r.Context())
+	if rctx == nil || rctx.Routes == nil {
+		return nil
+	}
+	path := r.URL.RawPath
+	if path == "" {
+		path = r.URL.Path
+	}
+	var candidates []string
+	candidates = append(candidates, standardMethods...)
+	candidates = append(candidates, webDAVMethods...)
+	candidates = append(candidates, config.ExtraMethods...)
+	var allowed []string
+	for _, m := range candidates {
+		m = strings.ToUpper(m)
+		if rctx.Routes.Match(chi.NewRouteContext(), m, path) {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// registerMethods teaches chi the WebDAV methods and EXTRA_METHODS; it
+// answers 405 to any other non-standard method. It must run before routes
+// are added.
+func registerMethods(extra []string) {
+	for _, m := range append(webDAVMethods, extra...) {
+		chi.RegisterMethod(strings.ToUpper(m))
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestForwardsMethods(t *testing.T) {
+	t.Setenv("EXTRA_METHODS", "purge")
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, body)
+	})
+	gw := startGateway(t, appDoc(port))
+
+	tests := []struct {
+		method string
+		body   string
+		status int
+		want   string
+	}{
+		{http.MethodPatch, `{"name":"x"}`, http.StatusOK, `PATCH {"name":"x"}`},
+		{"PROPFIND", "", http.StatusOK, "PROPFIND "},
+		{"PURGE", "", http.StatusOK, "PURGE "},
+		{"BREW", "", http.StatusMethodNotAllowed, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, fmt.Sprintf("%s/%d/items/1", gw.URL, port), strings.NewReader(tt.body))
+			resp, body := do(t, req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.want != "" && body != tt.want {
+				t.Errorf("backend saw %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// The default registry already exports the Go runtime (goroutines, memory,
+// GC) and process (open fds, RSS) collectors; these add the gateway's own.
+var (
+	upstreamConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_upstream_connections",
+		Help: "Open connections from the gateway to backends.",
+	})
+	listenerConnections = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_listener_connections",
+		Help: "Open client connections on the proxy listener.",
+	})
+	listenerRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_listener_rejected_total",
+		Help: "Client connections closed at accept time because MAX_CONNECTIONS was reached.",
+	})
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_requests_total",
+		Help: "Proxied requests by app, response status code and class (2xx, 5xx, ...).",
+	}, []string{"app", "code", "class"})
+	// Gateway-shed responses and upstream-origin errors are kept apart, as
+	// both show up as non-2xx answers in gateway_requests_total
+	shedRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_shed_total",
+		Help: "Requests the gateway turned away itself to protect an app or itself, by app (empty when shed before the app is known) and reason.",
+	}, []string{"app", "reason"})
+	upstreamErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_upstream_errors_total",
+		Help: "Requests that failed because of the backend, by app (empty for DEFAULT_BACKEND and overrides) and reason.",
+	}, []string{"app", "reason"})
+)
+
+// Reasons for shedding a request
+const (
+	shedRateLimit   = "rate_limit"
+	shedQuota       = "quota"
+	shedConcurrency = "concurrency"
+	shedCircuitOpen = "circuit_open"
+	shedThrottle    = "throttle"
+	shedIPLimit     = "ip_limit"
+)
+
+// Reasons for an upstream error
+const (
+	upstreamTimeout     = "timeout"
+	upstreamConnection  = "connection"
+	upstreamNoInstances = "no_instances"
+	upstreamServerError = "server_error"
+)
+
+// countShed records a request the gateway answered with a 429 or 503 of its
+// own making; such requests are never counted as usage of the app. port is
+// 0 when the request was shed before its app was resolved.
+func countShed(port int, reason string) {
+	shedRequests.WithLabelValues(appLabel(port), reason).Inc()
+}
+
+// countUpstreamError records a request that failed because of its backend
+func countUpstreamError(port int, reason string) {
+	upstreamErrors.WithLabelValues(appLabel(port), reason).Inc()
+}
+
+func appLabel(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return strconv.Itoa(port)
+}
+
+// countResponse records the status a request to the app on port was answered
+// with, whether it came from the backend or the gateway itself
+func countResponse(port, status int) {
+	if status == 0 {
+		status = http.StatusOK
+	}
+	requestsTotal.WithLabelValues(strconv.Itoa(port), strconv.Itoa(status), strconv.Itoa(status/100)+"xx").Inc()
+	if status >= 500 {
+		recordError(port, time.Now())
+	}
+}
+
+// trackedConn decrements its gauge exactly once when closed
+type trackedConn struct {
+	net.Conn
+	gauge   prometheus.Gauge
+	release func()
+	once    sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	c.once.Do(func() {
+		c.gauge.Dec()
+		if c.release != nil {
+			c.release()
+		}
+	})
+	return c.Conn.Close()
+}
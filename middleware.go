@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// cleanPath normalizes the routing path before it is matched, collapsing
+// "//", "." and ".." segments so "/8080//users/" and "/8080/users/" reach
+// the same app and backend path. Unlike chi's middleware.CleanPath it keeps
+// a trailing slash unless stripSlashes is set, since some backends are
+// slash-sensitive.
+//
+// The path stays percent-encoded, so an encoded slash ("%2F") is part of
+// its segment rather than a separator and reaches the backend as sent.
+// Encoded dots are decoded first, as "%2E%2E" is the same segment as "..".
+func cleanPath(stripSlashes bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rctx := chi.RouteContext(r.Context())
+			if rctx != nil && rctx.RoutePath == "" {
+				escaped := encodedDots.Replace(r.URL.EscapedPath())
+				p := path.Clean("/" + escaped)
+				if !stripSlashes && p != "/" && strings.HasSuffix(escaped, "/") {
+					p += "/"
+				}
+				rctx.RoutePath = p
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+var encodedDots = strings.NewReplacer("%2E", ".", "%2e", ".")
+
+// routePath returns the normalized path the router matched on, falling back to
+// the request path when no normalization ran. It is percent-encoded as the
+// client sent it; this is the path forwarded upstream.
+func routePath(r *http.Request) string {
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePath != "" {
+		return rctx.RoutePath
+	}
+	return r.URL.EscapedPath()
+}
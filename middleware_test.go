@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func TestForwardsEncodedPath(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, r.URL.EscapedPath())
+	})
+
+	for _, base := range []string{"", "/gateway"} {
+		t.Run("base="+base, func(t *testing.T) {
+			t.Setenv("BASE_PATH", base)
+			gw := startGateway(t, appDoc(port))
+
+			for _, path := range []string{
+				"/files/a%2Fb.txt",
+				"/files/my%20report.pdf",
+				"/files/a%2Fb/c%20d%3Fe",
+			} {
+				want := fmt.Sprintf("/%d%s", port, path)
+				resp, body := get(t, gw, base+want)
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("%s status = %d: %s", path, resp.StatusCode, body)
+				}
+				if body != want {
+					t.Errorf("backend saw %q, want %q", body, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readconcern"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/mongo/writeconcern"
+)
+
+// MongoConfig tunes the MongoDB client beyond what MONGO_URI sets. Zero
+// values leave the driver's defaults, or the URI's options, in place.
+type MongoConfig struct {
+	MaxPoolSize    int           // MONGO_MAX_POOL_SIZE
+	ConnectTimeout time.Duration // MONGO_CONNECT_TIMEOUT
+	SocketTimeout  time.Duration // MONGO_SOCKET_TIMEOUT
+	// ReadConcern is local, available, majority, linearizable or snapshot
+	// (MONGO_READ_CONCERN)
+	ReadConcern string
+	// WriteConcern is majority or a number of nodes (MONGO_WRITE_CONCERN)
+	WriteConcern string
+	// UsageWriteConcern overrides WriteConcern for the count updates made
+	// on every request (USAGE_WRITE_CONCERN). Unset, they are acknowledged
+	// like other writes, by the primary unless configured otherwise. 0
+	// doesn't wait for the server at all, cheapest but a failed
+	// write goes unnoticed and its counts are lost once newer ones are
+	// written; majority survives a failover, which billing may need, at
+	// the cost of latency on every request.
+	UsageWriteConcern string
+	// TLSCAFile is a PEM bundle of the CAs the server's certificate is
+	// checked against (MONGO_TLS_CA_FILE); it turns TLS on
+	TLSCAFile string
+}
+
+// clientOptions builds the client options for uri, rejecting invalid
+// settings
+func (mc MongoConfig) clientOptions(uri string) (*options.ClientOptions, error) {
+	opts := options.Client().ApplyURI(uri)
+	if mc.MaxPoolSize < 0 || mc.ConnectTimeout < 0 || mc.SocketTimeout < 0 {
+		return nil, fmt.Errorf("MONGO_MAX_POOL_SIZE, MONGO_CONNECT_TIMEOUT and MONGO_SOCKET_TIMEOUT must not be negative")
+	}
+	if mc.MaxPoolSize > 0 {
+		opts.SetMaxPoolSize(uint64(mc.MaxPoolSize))
+	}
+	if mc.ConnectTimeout > 0 {
+		opts.SetConnectTimeout(mc.ConnectTimeout)
+	}
+	if mc.SocketTimeout > 0 {
+		opts.SetSocketTimeout(mc.SocketTimeout)
+	}
+	switch mc.ReadConcern {
+	case "":
+	case "local", "available", "majority", "linearizable", "snapshot":
+		opts.SetReadConcern(&readconcern.ReadConcern{Level: mc.ReadConcern})
+	default:
+		return nil, fmt.Errorf("invalid MONGO_READ_CONCERN %q", mc.ReadConcern)
+	}
+	if mc.WriteConcern != "" {
+		wc, err := parseWriteConcern("MONGO_WRITE_CONCERN", mc.WriteConcern)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetWriteConcern(wc)
+	}
+	if mc.UsageWriteConcern != "" {
+		if _, err := parseWriteConcern("USAGE_WRITE_CONCERN", mc.UsageWriteConcern); err != nil {
+			return nil, err
+		}
+	}
+	if mc.TLSCAFile != "" {
+		pem, err := os.ReadFile(mc.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading MONGO_TLS_CA_FILE: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("MONGO_TLS_CA_FILE %s holds no PEM certificates", mc.TLSCAFile)
+		}
+		opts.SetTLSConfig(&tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12})
+	}
+	return opts, opts.Validate()
+}
+
+// parseWriteConcern parses "majority" or a number of nodes
+func parseWriteConcern(key, v string) (*writeconcern.WriteConcern, error) {
+	if v == "majority" {
+		return writeconcern.Majority(), nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid %s %q: must be majority or a number of nodes", key, v)
+	}
+	return &writeconcern.WriteConcern{W: n}, nil
+}
+
+// mongoStore keeps the apps and API keys in MongoDB collections
+// (STORAGE=mongo)
+type mongoStore struct {
+	client *mongo.Client
+	apps   *mongo.Collection
+	keys   *mongo.Collection
+	usage  *mongo.Collection
+	// counts is apps with the USAGE_WRITE_CONCERN, for the count updates;
+	// usage and history have it too
+	counts  *mongo.Collection
+	history *mongo.Collection
+}
+
+// newMongoStore connects to MongoDB (MONGO_URI, tuned by config.Mongo) and
+// uses the MONGO_COLLECTION, APIKEYS_COLLECTION and USAGE_COLLECTION
+// collections of MONGO_DATABASE. disconnect must be called on shutdown.
+func newMongoStore(uri, database, collection string) (s mongoStore, disconnect func(), err error) {
+	opts, err := config.Mongo.clientOptions(uri)
+	if err != nil {
+		return s, nil, err
+	}
+	// The driver connects lazily and in the background for the client's
+	// whole life, so it gets a context that is never canceled; operations
+	// bring their own timeouts
+	client, err := mongo.Connect(context.Background(), opts)
+	if err != nil {
+		return s, nil, err
+	}
+	disconnect = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Disconnect(ctx); err != nil {
+			log.Printf("Error disconnecting from MongoDB: %v", err)
+		}
+	}
+	db := client.Database(database)
+	countOpts := options.Collection()
+	if config.Mongo.UsageWriteConcern != "" {
+		// Validated by clientOptions
+		wc, _ := parseWriteConcern("USAGE_WRITE_CONCERN", config.Mongo.UsageWriteConcern)
+		countOpts.SetWriteConcern(wc)
+	}
+	return mongoStore{
+		client:  client,
+		apps:    db.Collection(collection),
+		keys:    db.Collection(config.APIKeysCollection),
+		usage:   db.Collection(config.UsageCollection, countOpts),
+		counts:  db.Collection(collection, countOpts),
+		history: db.Collection(config.UsageHistoryCollection, countOpts),
+	}, disconnect, nil
+}
+
+func (s mongoStore) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+// LoadApps reads every app document from the collection. Documents that fail
+// to decode are logged and skipped. Decoding is spread over APP_LOAD_WORKERS
+// goroutines while the cursor is drained, which matters for large
+// collections; of several documents for the same port, the last one read
+// wins.
+func (s mongoStore) LoadApps(ctx context.Context) (map[int]*App, error) {
+	cursor, err := s.apps.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+	return decodeApps(ctx, cursor, config.AppLoadWorkers)
+}
+
+// decodeApps decodes the app documents of cursor on workers goroutines. As
+// when decoding in order, the last of several documents for a port wins.
+func decodeApps(ctx context.Context, cursor *mongo.Cursor, workers int) (map[int]*App, error) {
+	if workers < 1 {
+		workers = 1
+	}
+	type indexed struct {
+		i   int
+		doc bson.Raw
+		app *App
+	}
+	docs := make(chan indexed, workers)
+	decoded := make(chan indexed, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for d := range docs {
+				var app App
+				if err := bson.Unmarshal(d.doc, &app); err != nil {
+					log.Printf("Error decoding app from MongoDB: %v", err)
+					continue
+				}
+				app.prepare()
+				decoded <- indexed{i: d.i, app: &app}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(decoded)
+	}()
+
+	apps := make(map[int]*App)
+	done := make(chan struct{})
+	go func() {
+		// Workers finish out of order; the cursor position decides
+		order := make(map[int]int)
+		for d := range decoded {
+			if i, ok := order[d.app.Port]; ok && i > d.i {
+				continue
+			}
+			order[d.app.Port] = d.i
+			apps[d.app.Port] = d.app
+		}
+		close(done)
+	}()
+
+	for i := 0; cursor.Next(ctx); i++ {
+		// Current is reused by the next call to Next
+		docs <- indexed{i: i, doc: append(bson.Raw(nil), cursor.Current...)}
+	}
+	close(docs)
+	<-done
+	return apps, cursor.Err()
+}
+
+func (s mongoStore) RegisterApp(ctx context.Context, port int) error {
+	filter := bson.M{"port": port}
+	update := bson.M{"$setOnInsert": bson.M{"port": port, "count": 0}}
+	_, err := s.apps.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return err
+}
+
+func (s mongoStore) AddUsage(ctx context.Context, deltas []*UsageDelta) error {
+	models := make([]mongo.WriteModel, 0, len(deltas))
+	for _, d := range deltas {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"port": d.Port}).
+			SetUpdate(bson.M{
+				"$inc": bson.M{"count": d.Count, "bytes_in": d.BytesIn, "bytes_out": d.BytesOut},
+				"$set": bson.M{"cycle_count": d.CycleCount, "cycle_start": d.CycleStart},
+			}))
+	}
+	_, err := s.counts.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	// Unordered, so the operations other than the failed ones were applied
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil && len(bwe.WriteErrors) > 0 {
+		failed := make([]*UsageDelta, 0, len(bwe.WriteErrors))
+		for _, we := range bwe.WriteErrors {
+			failed = append(failed, deltas[we.Index])
+		}
+		return &unwrittenDeltas{deltas: failed, err: err}
+	}
+	return ignoreUnacknowledged(err)
+}
+
+// ignoreUnacknowledged treats the error the driver returns for every write
+// made with USAGE_WRITE_CONCERN=0 as success
+func ignoreUnacknowledged(err error) error {
+	if errors.Is(err, mongo.ErrUnacknowledgedWrite) {
+		return nil
+	}
+	return err
+}
+
+func (s mongoStore) LoadTenantUsage(ctx context.Context) ([]*TenantUsage, error) {
+	cursor, err := s.usage.Find(ctx, bson.M{"tenant": bson.M{"$ne": ""}})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	var usage []*TenantUsage
+	for cursor.Next(ctx) {
+		var u TenantUsage
+		if err := cursor.Decode(&u); err != nil {
+			log.Printf("Error decoding tenant usage from MongoDB: %v", err)
+			continue
+		}
+		usage = append(usage, &u)
+	}
+	return usage, cursor.Err()
+}
+
+func (s mongoStore) SaveTenantUsage(ctx context.Context, u *TenantUsage) error {
+	filter := bson.M{"tenant": u.Tenant, "port": u.Port}
+	update := bson.M{"$set": bson.M{
+		"count":     u.Count,
+		"bytes_in":  u.BytesIn,
+		"bytes_out": u.BytesOut,
+	}}
+	_, err := s.usage.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	return ignoreUnacknowledged(err)
+}
+
+func (s mongoStore) AddUsageHistory(ctx context.Context, buckets []*UsageBucket) error {
+	models := make([]mongo.WriteModel, 0, len(buckets))
+	for _, b := range buckets {
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(bson.M{"port": b.Port, "tenant": b.Tenant, "hour": b.Hour}).
+			SetUpdate(bson.M{"$inc": bson.M{"count": b.Count, "bytes_in": b.BytesIn, "bytes_out": b.BytesOut}}).
+			SetUpsert(true))
+	}
+	_, err := s.history.BulkWrite(ctx, models, options.BulkWrite().SetOrdered(false))
+	// Unordered, so the operations other than the failed ones were applied
+	var bwe mongo.BulkWriteException
+	if errors.As(err, &bwe) && bwe.WriteConcernError == nil && len(bwe.WriteErrors) > 0 {
+		failed := make([]*UsageBucket, 0, len(bwe.WriteErrors))
+		for _, we := range bwe.WriteErrors {
+			failed = append(failed, buckets[we.Index])
+		}
+		return &unwrittenBuckets{buckets: failed, err: err}
+	}
+	return ignoreUnacknowledged(err)
+}
+
+// Rollup runs an aggregation pipeline over the hourly buckets for ranged
+// queries, otherwise over the apps' counters, or the tenants' for
+// group=tenant and tenant-filtered queries. The cursor is read one batch at
+// a time, so the result never has to fit in memory.
+func (s mongoStore) Rollup(ctx context.Context, q RollupQuery, emit func(row map[string]any) error) error {
+	coll := s.apps
+	match := bson.M{}
+	switch {
+	case q.ranged():
+		coll = s.history
+		hour := bson.M{}
+		if !q.From.IsZero() {
+			hour["$gte"] = q.From
+		}
+		if !q.To.IsZero() {
+			hour["$lt"] = q.To
+		}
+		match["hour"] = hour
+		if q.Tenant != "" {
+			match["tenant"] = q.Tenant
+		}
+	case q.Group == "tenant" || q.Tenant != "":
+		coll = s.usage
+		if q.Tenant != "" {
+			match["tenant"] = q.Tenant
+		}
+	}
+
+	var id any
+	switch q.Group {
+	case "app":
+		id = "$port"
+	case "tenant":
+		id = "$tenant"
+	case "hour":
+		id = "$hour"
+	}
+	sort := bson.D{{Key: "count", Value: -1}, {Key: "_id", Value: 1}}
+	if q.Group == "hour" {
+		sort = bson.D{{Key: "_id", Value: 1}}
+	}
+	pipeline := mongo.Pipeline{
+		{{Key: "$match", Value: match}},
+		{{Key: "$group", Value: bson.M{
+			"_id":       id,
+			"count":     bson.M{"$sum": "$count"},
+			"bytes_in":  bson.M{"$sum": "$bytes_in"},
+			"bytes_out": bson.M{"$sum": "$bytes_out"},
+		}}},
+		{{Key: "$sort", Value: sort}},
+	}
+	if q.Top > 0 {
+		pipeline = append(pipeline, bson.D{{Key: "$limit", Value: q.Top}})
+	}
+	project := bson.M{"_id": 0, "count": 1, "bytes_in": 1, "bytes_out": 1}
+	if id != nil {
+		project[q.Group] = "$_id"
+	}
+	pipeline = append(pipeline, bson.D{{Key: "$project", Value: project}})
+
+	cursor, err := coll.Aggregate(ctx, pipeline, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return err
+	}
+	defer cursor.Close(ctx)
+	for cursor.Next(ctx) {
+		var row bson.M
+		if err := cursor.Decode(&row); err != nil {
+			return err
+		}
+		if err := emit(row); err != nil {
+			return err
+		}
+	}
+	return cursor.Err()
+}
+
+func (s mongoStore) SetActivePool(ctx context.Context, port int, color string) error {
+	filter := bson.M{"port": port}
+	update := bson.M{"$set": bson.M{"blue_green.active": color}}
+	_, err := s.apps.UpdateOne(ctx, filter, update)
+	return err
+}
+
+func (s mongoStore) LoadAPIKeys(ctx context.Context) (map[string]*APIKey, error) {
+	cursor, err := s.keys.Find(ctx, bson.M{})
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	keys := make(map[string]*APIKey)
+	for cursor.Next(ctx) {
+		var k APIKey
+		if err := cursor.Decode(&k); err != nil {
+			log.Printf("Error decoding API key from MongoDB: %v", err)
+			continue
+		}
+		keys[k.Key] = &k
+	}
+	return keys, cursor.Err()
+}
+
+func (s mongoStore) InsertAPIKey(ctx context.Context, key *APIKey) error {
+	_, err := s.keys.InsertOne(ctx, key)
+	return err
+}
+
+func (s mongoStore) ExpireAPIKeys(ctx context.Context, principal, keep string, cutoff time.Time) error {
+	filter := bson.M{
+		"principal": principal,
+		"key":       bson.M{"$ne": keep},
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$exists": false}},
+			bson.M{"expires_at": bson.M{"$gt": cutoff}},
+		},
+	}
+	_, err := s.keys.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"expires_at": cutoff}})
+	return err
+}
+
+func (s mongoStore) DeleteAPIKey(ctx context.Context, key string) (bool, error) {
+	res, err := s.keys.DeleteOne(ctx, bson.M{"key": key})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount > 0, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+)
+
+func appCursor(t testing.TB, docs []interface{}) *mongo.Cursor {
+	t.Helper()
+	cursor, err := mongo.NewCursorFromDocuments(docs, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cursor
+}
+
+func TestDecodeAppsLastDuplicateWins(t *testing.T) {
+	var docs []interface{}
+	for i := 0; i < 1000; i++ {
+		docs = append(docs, bson.M{"port": 8000 + i%10, "count": i})
+	}
+	apps, err := decodeApps(context.Background(), appCursor(t, docs), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 10 {
+		t.Fatalf("decoded %d apps, want 10", len(apps))
+	}
+	for port, app := range apps {
+		if want := 990 + port - 8000; app.Count != want {
+			t.Errorf("app %d has count %d, want %d from its last document", port, app.Count, want)
+		}
+	}
+}
+
+func BenchmarkDecodeApps(b *testing.B) {
+	docs := make([]interface{}, 100000)
+	for i := range docs {
+		docs[i] = bson.M{"port": i + 1, "count": i, "instances": bson.A{"10.0.0.1:80", "10.0.0.2:80"}}
+	}
+	for _, workers := range []int{1, 8} {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				cursor := appCursor(b, docs)
+				b.StartTimer()
+				if _, err := decodeApps(context.Background(), cursor, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestMongoDisconnectAfterLoadTimeout runs past the startup load timeout,
+// which must not have canceled the client: it keeps trying to reach the
+// server and disconnects cleanly. No server is needed, as the driver
+// connects lazily.
+func TestMongoDisconnectAfterLoadTimeout(t *testing.T) {
+	saved := storeLoadTimeout
+	storeLoadTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { storeLoadTimeout = saved })
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	uri := fmt.Sprintf("mongodb://127.0.0.1:%d/?serverSelectionTimeoutMS=20&connectTimeoutMS=20", closedPort(t))
+	store, disconnect, err := newMongoStore(uri, "gateway_test", "apps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := loadFromStore(store); err == nil {
+		t.Fatal("loaded from an unreachable store")
+	}
+	time.Sleep(2 * storeLoadTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := store.Ping(ctx); errors.Is(err, context.Canceled) {
+		t.Errorf("ping after the load timeout: %v, the client's context was canceled", err)
+	}
+	disconnect()
+	if strings.Contains(logged.String(), "Error disconnecting") {
+		t.Errorf("disconnect failed: %s", logged.String())
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// OTLP/HTTP JSON encoding of the logs signal, covering only what the access
+// log needs
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano   string          `json:"timeUnixNano"`
+	SeverityNumber int             `json:"severityNumber"`
+	SeverityText   string          `json:"severityText"`
+	Body           otlpValue       `json:"body"`
+	Attributes     []otlpAttribute `json:"attributes"`
+	TraceID        string          `json:"traceId,omitempty"`
+	SpanID         string          `json:"spanId,omitempty"`
+}
+
+func otlpString(key, v string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &v}}
+}
+
+func otlpInt(key string, v int64) otlpAttribute {
+	s := strconv.FormatInt(v, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+// traceContext returns the trace and span IDs of a W3C traceparent header,
+// "" when it is missing or malformed
+func traceContext(r *http.Request) (traceID, spanID string) {
+	parts := strings.Split(r.Header.Get("Traceparent"), "-")
+	if len(parts) < 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return "", ""
+	}
+	return parts[1], parts[2]
+}
+
+// otlpRecords queues access log records for the exporter. Records are
+// dropped rather than blocking requests when the collector falls behind.
+var otlpRecords = make(chan otlpLogRecord, 4096)
+
+// exportOTLPLogs batches queued records and posts them to the collector at
+// endpoint (OTLP_ENDPOINT, e.g. http://collector:4318) once a second or
+// every 512 records.
+func exportOTLPLogs(endpoint string) {
+	url := strings.TrimSuffix(endpoint, "/") + "/v1/logs"
+	client := &http.Client{Timeout: 10 * time.Second}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var batch []otlpLogRecord
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		payload := map[string]any{"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpAttribute{
+				otlpString("service.name", config.OTLPServiceName),
+				otlpString("service.version", version),
+			}},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]string{"name": "gateway"},
+				"logRecords": batch,
+			}},
+		}}}
+		batch = nil
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Printf("Error encoding OTLP logs: %v", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Error exporting OTLP logs: %v", err)
+			return
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req)
+		if err != nil {
+			log.Printf("Error exporting OTLP logs: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("OTLP collector rejected logs: %s", resp.Status)
+		}
+	}
+
+	for {
+		select {
+		case rec := <-otlpRecords:
+			batch = append(batch, rec)
+			if len(batch) >= 512 {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// emitOTLPAccessLog queues the access log record of a completed request
+func emitOTLPAccessLog(r *http.Request, line string, status, size int, elapsed time.Duration, sample int) {
+	severity, text := 9, "INFO"
+	if status >= 500 {
+		severity, text = 17, "ERROR"
+	} else if status >= 400 {
+		severity, text = 13, "WARN"
+	}
+	traceID, spanID := traceContext(r)
+	rec := otlpLogRecord{
+		TimeUnixNano:   strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber: severity,
+		SeverityText:   text,
+		Body:           otlpValue{StringValue: &line},
+		Attributes: []otlpAttribute{
+			otlpString("http.request.method", r.Method),
+			otlpString("url.path", r.URL.Path),
+			otlpInt("http.response.status_code", int64(status)),
+			otlpString("client.address", clientIP(r)),
+			otlpInt("http.response.body.size", int64(size)),
+			otlpInt("gateway.duration_ms", elapsed.Milliseconds()),
+			otlpInt("gateway.sample_rate", int64(sample)),
+			otlpString("gateway.request_id", middleware.GetReqID(r.Context())),
+		},
+		TraceID: traceID,
+		SpanID:  spanID,
+	}
+	select {
+	case otlpRecords <- rec:
+	default:
+	}
+}
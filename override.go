@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const (
+	overrideHeader      = "X-Gateway-Upstream"
+	overrideTokenHeader = "X-Gateway-Admin-Token"
+)
+
+// upstreamOverride returns the host:port a request asks to be sent to with
+// X-Gateway-Upstream, for testing tools. It is only honoured with
+// UPSTREAM_OVERRIDE on and the admin token in X-Gateway-Admin-Token, as it
+// lets the caller reach any host the gateway can. Both headers are removed
+// so they never reach a backend. status is non-zero when the override must
+// be refused.
+func upstreamOverride(r *http.Request) (upstream string, status int, msg string) {
+	upstream = r.Header.Get(overrideHeader)
+	token := r.Header.Get(overrideTokenHeader)
+	r.Header.Del(overrideHeader)
+	r.Header.Del(overrideTokenHeader)
+	if upstream == "" || !config.UpstreamOverride {
+		return "", 0, ""
+	}
+	if config.AdminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(config.AdminToken)) != 1 {
+		log.Printf("[%s] Refused upstream override to %s from %s: bad admin token",
+			middleware.GetReqID(r.Context()), upstream, clientIP(r))
+		return "", http.StatusForbidden, "Upstream override not allowed"
+	}
+	if err := checkHostPort(upstream); err != nil {
+		return "", http.StatusBadRequest, "Invalid " + overrideHeader + ": " + err.Error()
+	}
+	log.Printf("[%s] Upstream override: %s %s sent to %s by %s",
+		middleware.GetReqID(r.Context()), r.Method, routePath(r), upstream, clientIP(r))
+	return upstream, 0, ""
+}
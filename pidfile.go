@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// writePIDFile records the process ID at path for init systems that
+// supervise by PID file. A file left behind by an earlier run is
+// overwritten.
+func writePIDFile(path string) error {
+	if old, err := os.ReadFile(path); err == nil {
+		log.Printf("Overwriting stale PID file %s (pid %s)", path, strings.TrimSpace(string(old)))
+	}
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0o644)
+}
+
+// removePIDFile deletes the PID file if it still holds this process's ID
+func removePIDFile(path string) {
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+	if err == nil && strings.TrimSpace(string(b)) != strconv.Itoa(os.Getpid()) {
+		// Another instance has taken over the file
+		return
+	}
+	if err := os.Remove(path); err != nil {
+		log.Printf("Error removing PID file: %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// The request pipeline, outermost middleware first. Every request goes
+// through the router stages; proxied requests then go through the proxy
+// stages before the handler resolves the app:
+//
+//	recover     turn a handler panic into a 500 (outermost, so it covers all)
+//	request_id  assign X-Request-Id, which the access log and errors carry
+//	access_log  log the request once it is done
+//	clean_path  normalize the routing and forwarded path
+//
+//	compress    gzip responses for clients that accept it (COMPRESSION)
+//	timing      time the gateway's phases for Server-Timing (SERVER_TIMING)
+//	loop        answer 508 to requests this gateway already forwarded (Via)
+//	ip_limit    bound the requests in flight per client IP (MAX_REQUESTS_PER_IP)
+//	throttle    bound the proxied requests in flight (THROTTLE_LIMIT)
+//	timeout     answer 503 once REQUEST_TIMEOUT is up
+//	auth        check credentials, per app or globally (see authenticate)
+//
+// Stages named in DISABLE_MIDDLEWARES are left out. Requests for
+// LIMIT_BYPASS_PATHS skip ip_limit and throttle.
+type stage struct {
+	name string
+	// on is false for stages whose feature is not configured
+	on bool
+	mw func() func(http.Handler) http.Handler
+}
+
+func routerStages() []stage {
+	return []stage{
+		{"recover", true, func() func(http.Handler) http.Handler { return middleware.Recoverer }},
+		{"request_id", true, func() func(http.Handler) http.Handler { return middleware.RequestID }},
+		{"access_log", true, func() func(http.Handler) http.Handler { return accessLog }},
+		{"clean_path", true, func() func(http.Handler) http.Handler { return cleanPath(config.StripSlashes) }},
+	}
+}
+
+func proxyStages() []stage {
+	return []stage{
+		{"compress", config.Compression, func() func(http.Handler) http.Handler {
+			return compress(config.CompressionLevel, config.CompressionMinSize, config.CompressionTypes)
+		}},
+		{"timing", config.ServerTiming, func() func(http.Handler) http.Handler { return withServerTiming }},
+		{"loop", true, func() func(http.Handler) http.Handler { return detectLoops }},
+		{"ip_limit", config.MaxRequestsPerIP > 0, func() func(http.Handler) http.Handler {
+			return skipOnBypass(limitPerIP(config.MaxRequestsPerIP, config.IPAllowlist))
+		}},
+		{"throttle", config.ThrottleLimit > 0, func() func(http.Handler) http.Handler {
+			return skipOnBypass(throttle(config.ThrottleLimit, config.ThrottleBacklog, config.ThrottleBacklogTimeout))
+		}},
+		{"timeout", config.RequestTimeout > 0, func() func(http.Handler) http.Handler {
+			return requestTimeout(config.RequestTimeout)
+		}},
+		{"auth", true, func() func(http.Handler) http.Handler { return authenticate(defaultAuth()) }},
+	}
+}
+
+// skipOnBypass wraps mw so requests for LIMIT_BYPASS_PATHS go straight to
+// the next handler, the check being made before mw runs
+func skipOnBypass(mw func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		limited := mw(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if bypassesLimits(r) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			limited.ServeHTTP(w, r)
+		})
+	}
+}
+
+// bypassesLimits reports whether r's routing path matches one of
+// LIMIT_BYPASS_PATHS. The path within the app is not matched, so no app's
+// own paths skip the limits unless named for it, e.g. "/8080/health".
+func bypassesLimits(r *http.Request) bool {
+	p := routePath(r)
+	for _, pattern := range config.LimitBypassPaths {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// routerMiddlewares returns the router stages for the main listener, or for
+// the admin listener without path cleaning
+func routerMiddlewares(admin bool) []func(http.Handler) http.Handler {
+	var stages []stage
+	for _, s := range routerStages() {
+		if admin && s.name == "clean_path" {
+			continue
+		}
+		stages = append(stages, s)
+	}
+	return build(stages)
+}
+
+func proxyMiddlewares() []func(http.Handler) http.Handler {
+	return build(proxyStages())
+}
+
+func build(stages []stage) []func(http.Handler) http.Handler {
+	var out []func(http.Handler) http.Handler
+	for _, s := range stages {
+		if !s.on {
+			continue
+		}
+		if disabledMiddleware(s.name) {
+			log.Printf("Middleware %s is disabled", s.name)
+			continue
+		}
+		out = append(out, s.mw())
+	}
+	return out
+}
+
+func disabledMiddleware(name string) bool {
+	for _, d := range config.DisabledMiddlewares {
+		if d == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDisabledMiddlewares rejects names in DISABLE_MIDDLEWARES that are not
+// stages, as a typo would otherwise leave the stage silently running
+func checkDisabledMiddlewares() error {
+	known := map[string]bool{}
+	for _, s := range append(routerStages(), proxyStages()...) {
+		known[s.name] = true
+	}
+	for _, d := range config.DisabledMiddlewares {
+		if !known[d] {
+			return fmt.Errorf("unknown middleware %q in DISABLE_MIDDLEWARES", d)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBypassesLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		want     bool
+	}{
+		{"named app path", []string{"/8080/health"}, "/8080/health", true},
+		{"other app's path", []string{"/8080/health"}, "/9090/health", false},
+		{"path within the app", []string{"/health"}, "/8080/health", false},
+		{"prefix", []string{"/8080/status/*"}, "/8080/status/db", true},
+		{"outside the list", []string{"/8080/health"}, "/8080/orders", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config.LimitBypassPaths = tt.patterns
+			t.Cleanup(func() { config.LimitBypassPaths = nil })
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if got := bypassesLimits(r); got != tt.want {
+				t.Errorf("bypassesLimits(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLimitBypassPaths(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Auth-Subject"))
+	})
+	app := fmt.Sprintf(`{"port": %d, "rate_limit": {"rate": 0.001, "burst": 1}}`, port)
+	health := fmt.Sprintf("/%d/health", port)
+
+	// By default no app path skips the limits
+	gw := startGateway(t, app)
+	get(t, gw, health)
+	if resp, _ := get(t, gw, health); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("second request for %s by default status = %d, want 429", health, resp.StatusCode)
+	}
+
+	t.Setenv("LIMIT_BYPASS_PATHS", health)
+	t.Setenv("API_KEY_AUTH", "true")
+	gw = startGateway(t, app)
+	key := mintKey(t, gw, `{"principal": "probe"}`)
+	for i := 0; i < 3; i++ {
+		if got := getWithKey(t, gw, health, key.Key); got != http.StatusOK {
+			t.Fatalf("request %d for %s status = %d, want 200", i+1, health, got)
+		}
+	}
+	orders := fmt.Sprintf("/%d/orders", port)
+	getWithKey(t, gw, orders, key.Key)
+	if got := getWithKey(t, gw, orders, key.Key); got != http.StatusTooManyRequests {
+		t.Errorf("second request for %s status = %d, want 429", orders, got)
+	}
+
+	// Bypassed paths are still authenticated, and clients cannot forge the
+	// identity the backend sees
+	if got := getWithKey(t, gw, health, ""); got != http.StatusUnauthorized {
+		t.Errorf("%s without a key status = %d, want 401", health, got)
+	}
+	req, _ := http.NewRequest(http.MethodGet, gw.URL+health, nil)
+	req.Header.Set("X-Api-Key", key.Key)
+	req.Header.Set("X-Auth-Subject", "admin")
+	if _, body := do(t, req); body != "" {
+		t.Errorf("backend saw the forged X-Auth-Subject %q", body)
+	}
+}
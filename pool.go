@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Instance is one backend serving an app
+type Instance struct {
+	Addr string // host:port
+	// Weight is the instance's relative share of traffic; 0 counts as 1
+	Weight int
+}
+
+func (in *Instance) weight() int {
+	if in.Weight <= 0 {
+		return 1
+	}
+	return in.Weight
+}
+
+// discovered holds the instances found by service discovery per app port.
+// Apps with a Discovery source use these instead of their static instances.
+var discovered = struct {
+	sync.RWMutex
+	m map[int][]*Instance
+}{m: make(map[int][]*Instance)}
+
+func setDiscovered(port int, instances []*Instance) {
+	discovered.Lock()
+	discovered.m[port] = instances
+	discovered.Unlock()
+}
+
+// appInstances returns the pool of instances serving the app: the discovered
+// ones when the app has a discovery source, the active pool of a blue-green
+// app, otherwise the default instance on localhost:<port> followed by the
+// app's static Instances.
+func appInstances(app *App, port int) []*Instance {
+	if app != nil && app.Discovery != nil {
+		discovered.RLock()
+		defer discovered.RUnlock()
+		return discovered.m[port]
+	}
+	if app != nil && app.BlueGreen != nil {
+		return app.BlueGreen.instances()
+	}
+	instances := []*Instance{{Addr: fmt.Sprintf("localhost:%d", port)}}
+	if app != nil {
+		for _, addr := range app.Instances {
+			instances = append(instances, &Instance{Addr: addr})
+		}
+	}
+	return instances
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// proxyTarget describes where and under which limits a request is forwarded
+type proxyTarget struct {
+	port     int
+	app      *App // nil when the port is not a registered app
+	upstream string
+	timeout  time.Duration
+	maxBody  int64
+}
+
+// proxyRequest forwards r to t and relays the answer. It reports whether r
+// was sent upstream, which it is not when it is answered from the cache, by
+// another request's coalesced fetch or rejected before forwarding.
+func proxyRequest(t proxyTarget, w http.ResponseWriter, r *http.Request) (sent bool) {
+	if t.maxBody > 0 {
+		if r.ContentLength > t.maxBody {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, t.maxBody)
+	}
+	if err := injectRequestFields(t.app, r); err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Error reading request body", http.StatusBadRequest)
+		}
+		return
+	}
+
+	addVia(r)
+	bl := startBodyLog(t, r)
+	defer bl.log()
+
+	// Bodies are buffered so they can be replayed; larger ones disable retries
+	attempts := 1
+	if isIdempotent(r.Method) && config.UpstreamRetries > 0 {
+		replayable, err := bufferBody(r, config.RetryMaxBody)
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+			} else {
+				http.Error(w, "Error reading request body", http.StatusBadRequest)
+			}
+			return
+		}
+		if replayable {
+			attempts += config.UpstreamRetries
+		}
+	}
+
+	// The budget covers every attempt and the waits between them
+	if config.RequestBudget > 0 {
+		ctx, cancelBudget := context.WithTimeout(r.Context(), config.RequestBudget)
+		defer cancelBudget()
+		r = r.WithContext(ctx)
+	}
+
+	var resp *http.Response
+	cancel := context.CancelFunc(func() {})
+	var err error
+	attempt := 0
+	fetched := false
+	fetch := func() {
+		resp, cancel, attempt, err = forward(t, r, attempts)
+		if err == nil {
+			resp, cancel, err = followInternalRedirects(t, r, resp, cancel)
+		}
+		fetched, sent = true, true
+		if err == nil {
+			rewriteCookies(t.app, resp.Header)
+			rewriteLocations(t, resp)
+			rewriteResponseBody(t.app, resp)
+		}
+	}
+	defer func() { cancel() }()
+
+	// Cache hits, including 304s answered from the cache, still count as a
+	// use of the app
+	key, cacheable := cacheKey(t, r)
+	if cacheable {
+		if e, ok := responses.lookup(key, r); ok {
+			serveCached(w, r, e, "HIT")
+			return
+		}
+
+		conditionals := stripConditionals(r.Header)
+		e, led := coalesce(key, func() *cacheEntry {
+			fetch()
+			if err != nil {
+				return nil
+			}
+			e, _ := storeResponse(key, t.app, r, resp)
+			return e
+		})
+		restoreConditionals(r.Header, conditionals)
+		if e != nil && e.matches(r) {
+			if fetched {
+				resp.Body.Close()
+			}
+			status := "MISS"
+			if !led {
+				status = "COALESCED"
+			}
+			serveCached(w, r, e, status)
+			return
+		}
+	}
+	if !fetched {
+		fetch()
+	}
+
+	if errors.Is(r.Context().Err(), context.DeadlineExceeded) {
+		if resp != nil {
+			resp.Body.Close()
+		}
+		w.Header().Set("X-Gateway-Attempts", strconv.Itoa(attempt))
+		countUpstreamError(t.port, upstreamTimeout)
+		gatewayTimeout(w, t.port, "Request budget exhausted", config.RequestBudget)
+		return
+	}
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		if !errors.As(err, &maxBytesErr) {
+			log.Printf("[%s] Error forwarding %s %s to app %d at %s after %d attempt(s): %v",
+				middleware.GetReqID(r.Context()), r.Method, routePath(r), t.port, t.upstream, attempt, err)
+		}
+		switch {
+		case errors.Is(err, errLoop):
+			jsonError(w, http.StatusLoopDetected, "Upstream is the gateway itself")
+		case errors.Is(err, errRedirectLoop):
+			jsonError(w, http.StatusLoopDetected, "Internal redirect loop")
+		case errors.As(err, &maxBytesErr):
+			http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		case errors.Is(err, context.DeadlineExceeded):
+			w.Header().Set("X-Gateway-Attempts", strconv.Itoa(attempt))
+			countUpstreamError(t.port, upstreamTimeout)
+			gatewayTimeout(w, t.port, "Upstream timeout", t.timeout)
+		default:
+			countUpstreamError(t.port, upstreamConnection)
+			http.Error(w, "Error forwarding request", http.StatusInternalServerError)
+		}
+		return
+	}
+	defer resp.Body.Close()
+	bl.response(resp)
+	if resp.StatusCode >= 500 {
+		countUpstreamError(t.port, upstreamServerError)
+	}
+
+	if resp.StatusCode >= 400 && writeErrorPage(w, t.app, resp.StatusCode) {
+		return
+	}
+	if t.app != nil {
+		compareShadow(t, r, resp)
+	}
+
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	w.Header().Add("Via", viaHop(resp.ProtoMajor, resp.ProtoMinor))
+	writeServerTiming(w, r)
+	// A HEAD response has no body but describes the GET one, so its
+	// Content-Length is passed on as is
+	if r.Method == http.MethodHead {
+		if w.Header().Get("Content-Length") == "" && resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(resp.StatusCode)
+		return
+	}
+	w.WriteHeader(resp.StatusCode)
+	copyResponse(w, t.app, resp)
+	return
+}
+
+// gatewayTimeout answers 504 with a JSON body naming the app and the timeout
+// that ran out, and a Retry-After of TIMEOUT_RETRY_AFTER
+func gatewayTimeout(w http.ResponseWriter, port int, msg string, timeout time.Duration) {
+	if secs := int(config.TimeoutRetryAfter.Round(time.Second) / time.Second); secs > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+	}
+	writeJSON(w, http.StatusGatewayTimeout, map[string]any{
+		"error":      msg,
+		"app":        port,
+		"timeout":    timeout.String(),
+		"timeout_ms": timeout.Milliseconds(),
+	})
+}
+
+// forward sends r upstream, retrying up to attempts times in total while the
+// failures look transient. It returns the last response or error and how many
+// attempts were made; cancel must be called once the body is no longer needed.
+func forward(t proxyTarget, r *http.Request, attempts int) (resp *http.Response, cancel context.CancelFunc, attempt int, err error) {
+	hedge, hedged := hedgeUpstream(t, r)
+	for attempt = 1; ; attempt++ {
+		// Only the first attempt is hedged, bounding a request to one hedge
+		if hedged && attempt == 1 {
+			resp, cancel, err = sendHedged(t, hedge, r)
+		} else {
+			resp, cancel, err = sendUpstream(t, r)
+		}
+		if attempt == attempts || !shouldRetry(resp, err) {
+			return resp, cancel, attempt, err
+		}
+		delay, ok := retryDelay(resp, attempt, retryMaxDelay(t))
+		if !ok || !waitRetry(r.Context(), delay) {
+			return resp, cancel, attempt, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+	}
+}
+
+// setUpstreamHost sets the Host of req, sent upstream on behalf of r, to
+// forwardedHost
+func setUpstreamHost(t proxyTarget, r, req *http.Request) {
+	req.Host = forwardedHost(t, r)
+}
+
+// forwardedHost is the Host sent upstream for r: the app's UpstreamHost or
+// else r's Host, unless the app asks for the address dialed (DialHost), for
+// which it is empty
+func forwardedHost(t proxyTarget, r *http.Request) string {
+	switch {
+	case t.app != nil && t.app.UpstreamHost != "":
+		return t.app.UpstreamHost
+	case t.app != nil && t.app.DialHost:
+		// Left empty, the URL's host is sent
+		return ""
+	default:
+		return r.Host
+	}
+}
+
+// sendUpstream makes a single attempt at forwarding r. The returned cancel
+// releases the attempt's timeout and must be called once the response body is
+// no longer needed.
+func sendUpstream(t proxyTarget, r *http.Request) (*http.Response, context.CancelFunc, error) {
+	if isSelf(t.upstream) {
+		return nil, func() {}, errLoop
+	}
+	ctx, cancel := r.Context(), context.CancelFunc(func() {})
+	if t.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+	}
+
+	proxyURL := fmt.Sprintf("http://%s%s", t.upstream, routePath(r))
+	body := r.Body
+	if r.GetBody != nil {
+		// Buffered by bufferBody, so every attempt sends the whole body
+		body, _ = r.GetBody()
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, proxyURL, body)
+	if err != nil {
+		return nil, cancel, err
+	}
+	req.Header = r.Header
+	setUpstreamHost(t, r, req)
+	if t.app != nil && t.app.upstreamProxy != nil {
+		req = withUpstreamProxy(req, t.app.upstreamProxy.url)
+	}
+	// Sends Connection: close and drops the connection after the response
+	req.Close = t.app != nil && t.app.DisableKeepAlives
+	if r.GetBody != nil {
+		req.ContentLength = r.ContentLength
+		req.GetBody = r.GetBody
+	} else if r.ContentLength != 0 {
+		// Streamed as received: with its Content-Length if the client sent
+		// one, chunked (-1) otherwise. NewRequest can't tell from the body.
+		req.ContentLength = r.ContentLength
+	}
+
+	req = traceUpstreamConnect(r, req)
+	done := timePhase(r, "upstream")
+	start := time.Now()
+	resp, err := upstreamClient.Do(req)
+	done()
+	if err != nil {
+		return nil, cancel, err
+	}
+	observeLatency(t.port, start, resp)
+	return resp, cancel, nil
+}
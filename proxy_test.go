@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHeadKeepsContentLength(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1234")
+		if r.Method != http.MethodHead {
+			w.Write(make([]byte, 1234))
+		}
+	})
+	gw := startGateway(t, appDoc(port))
+
+	req, _ := http.NewRequest(http.MethodHead, fmt.Sprintf("%s/%d/file", gw.URL, port), nil)
+	resp, body := do(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Length"); got != "1234" {
+		t.Errorf("Content-Length = %q, want 1234", got)
+	}
+	if body != "" {
+		t.Errorf("HEAD response has a %d byte body", len(body))
+	}
+}
+
+func TestRangeRequestPassthrough(t *testing.T) {
+	t.Setenv("COMPRESSION", "true")
+	t.Setenv("COMPRESSION_MIN_SIZE", "1")
+	content := strings.Repeat("0123456789", 100)
+	modified := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		http.ServeContent(w, r, "data.txt", modified, strings.NewReader(content))
+	})
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "cache_ttl_ms": 60000}`, port))
+
+	tests := []struct {
+		name    string
+		ifRange string
+		status  int
+		body    string
+	}{
+		{"range", "", http.StatusPartialContent, content[10:20]},
+		{"matching If-Range", `"v1"`, http.StatusPartialContent, content[10:20]},
+		{"stale If-Range", `"v0"`, http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d/data.txt", gw.URL, port), nil)
+			req.Header.Set("Range", "bytes=10-19")
+			req.Header.Set("Accept-Encoding", "gzip")
+			if tt.ifRange != "" {
+				req.Header.Set("If-Range", tt.ifRange)
+			}
+			resp, body := do(t, req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if enc := resp.Header.Get("Content-Encoding"); enc != "" && tt.status == http.StatusPartialContent {
+				t.Errorf("206 compressed with %s", enc)
+			}
+			if tt.status == http.StatusPartialContent {
+				if got := resp.Header.Get("Content-Range"); got != "bytes 10-19/1000" {
+					t.Errorf("Content-Range = %q", got)
+				}
+				if body != tt.body {
+					t.Errorf("body = %q, want %q", body, tt.body)
+				}
+			}
+			if got := resp.Header.Get("Accept-Ranges"); got != "bytes" {
+				t.Errorf("Accept-Ranges = %q, want bytes", got)
+			}
+		})
+	}
+}
+
+func TestStreamsChunkedBody(t *testing.T) {
+	t.Setenv("RETRY_MAX_BODY", "16")
+	tests := []struct {
+		name    string
+		retries string
+		body    string
+		chunked bool
+	}{
+		{"no retries", "0", "hello", true},
+		// Buffered for retries, so sent with its length
+		{"small", "1", "hello", false},
+		// Past RETRY_MAX_BODY, streamed as it came
+		{"large", "1", strings.Repeat("x", 1000), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("UPSTREAM_RETRIES", tt.retries)
+			var chunked bool
+			var got []byte
+			port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				chunked = len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked"
+				got, _ = io.ReadAll(r.Body)
+			})
+			gw := startGateway(t, appDoc(port))
+
+			pr, pw := io.Pipe()
+			go func() {
+				for i := 0; i < len(tt.body); i += 100 {
+					pw.Write([]byte(tt.body[i:min(i+100, len(tt.body))]))
+				}
+				pw.Close()
+			}()
+			req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%d/upload", gw.URL, port), pr)
+			resp, body := do(t, req)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if string(got) != tt.body {
+				t.Errorf("backend got %d bytes, want %d", len(got), len(tt.body))
+			}
+			if chunked != tt.chunked {
+				t.Errorf("chunked upstream = %v, want %v", chunked, tt.chunked)
+			}
+		})
+	}
+}
+
+func TestUpstreamHostOverride(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	})
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "upstream_host": "api.internal.example"}`, port))
+
+	req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d/", gw.URL, port), nil)
+	req.Host = "public.example.com"
+	if _, body := do(t, req); body != "api.internal.example" {
+		t.Errorf("backend saw Host %q, want api.internal.example", body)
+	}
+}
+
+func TestForwardedHost(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		io.WriteString(w, r.Host)
+	})
+	tests := []struct {
+		name string
+		app  string
+		host string
+		want string
+	}{
+		{"client Host by default", `{"port": %d}`, "public.example.com", "public.example.com"},
+		{"address dialed", `{"port": %d, "dial_host": true}`, "public.example.com", fmt.Sprintf("localhost:%d", port)},
+		// Cached per Host, so another site's page is not served
+		{"cached by client Host", `{"port": %d, "cache_ttl_ms": 60000}`, "a.example.com", "a.example.com"},
+		{"cached by client Host, other site", `{"port": %d, "cache_ttl_ms": 60000}`, "b.example.com", "b.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gw := startGateway(t, fmt.Sprintf(tt.app, port))
+			req, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d/page", gw.URL, port), nil)
+			req.Host = tt.host
+			if _, body := do(t, req); body != tt.want {
+				t.Errorf("backend saw Host %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
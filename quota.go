@@ -0,0 +1,34 @@
+package main
+
+import "time"
+
+// cycleStart returns the start of the quota cycle containing now. Cycles run
+// from day (1-28) of one month, midnight UTC, to the same day of the next.
+func cycleStart(now time.Time, day int) time.Time {
+	now = now.UTC()
+	start := time.Date(now.Year(), now.Month(), day, 0, 0, 0, 0, time.UTC)
+	if now.Before(start) {
+		start = start.AddDate(0, -1, 0)
+	}
+	return start
+}
+
+// rollCycle resets the app's cycle count once a new cycle has begun. The
+// caller must hold the usageData lock.
+func (app *App) rollCycle(now time.Time) {
+	start := cycleStart(now, config.QuotaCycleDay)
+	if !app.CycleStart.Equal(start) {
+		app.CycleStart = start
+		app.CycleCount = 0
+	}
+}
+
+// overQuota reports whether the app has used up its quota for the current
+// cycle. The caller must hold the usageData lock.
+func (app *App) overQuota(now time.Time) bool {
+	if app.Quota <= 0 {
+		return false
+	}
+	app.rollCycle(now)
+	return app.CycleCount >= app.Quota
+}
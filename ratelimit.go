@@ -0,0 +1,229 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var rateLimited = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_rate_limited_total",
+	Help: "Requests rejected by the app's rate limit.",
+}, []string{"app"})
+
+// Rate limiting algorithms
+const (
+	// algorithmBucket is a token bucket, which lets bursts through
+	algorithmBucket = "bucket"
+	// algorithmSlidingWindow strictly counts the requests in the last window.
+	// It logs every admitted request, so it holds up to Limit timestamps
+	// per app in memory; keep Limit modest or prefer the bucket.
+	algorithmSlidingWindow = "sliding_window"
+)
+
+// RateLimit throttles the requests to an app
+type RateLimit struct {
+	// Algorithm is "bucket" (default) or "sliding_window"
+	Algorithm string `bson:"algorithm,omitempty"`
+
+	// Rate is how many tokens are added per second and Burst how many the
+	// bucket holds (default Rate rounded up)
+	Rate  float64 `bson:"rate,omitempty"`
+	Burst int64   `bson:"burst,omitempty"`
+
+	// Limit is the total cost admitted in any rolling WindowMS for the
+	// sliding window
+	Limit    int64 `bson:"limit,omitempty"`
+	WindowMS int64 `bson:"window_ms,omitempty"`
+
+	// Costs set how many tokens matching requests take; the first match wins
+	// and other requests cost 1. Costs above the limit are charged as the limit.
+	Costs []RequestCost `bson:"costs,omitempty"`
+}
+
+// RequestCost prices the requests matching Method (empty for any) and Path,
+// which is matched like RouteLimit.Path
+type RequestCost struct {
+	Method string `bson:"method,omitempty"`
+	Path   string `bson:"path"`
+	Cost   int64  `bson:"cost"`
+}
+
+func (rl *RateLimit) slidingWindow() bool {
+	return rl.Algorithm == algorithmSlidingWindow
+}
+
+func (rl *RateLimit) enabled() bool {
+	if rl.slidingWindow() {
+		return rl.Limit > 0 && rl.WindowMS > 0
+	}
+	return rl.Rate > 0
+}
+
+// burst is the most a single window or bucket admits
+func (rl *RateLimit) burst() float64 {
+	if rl.slidingWindow() {
+		return float64(rl.Limit)
+	}
+	if rl.Burst > 0 {
+		return float64(rl.Burst)
+	}
+	return math.Ceil(rl.Rate)
+}
+
+// cost returns the tokens a request for path p takes
+func (rl *RateLimit) cost(method, p string) float64 {
+	for _, c := range rl.Costs {
+		if (c.Method == "" || strings.EqualFold(c.Method, method)) && matchPath(c.Path, p) {
+			return math.Min(float64(c.Cost), rl.burst())
+		}
+	}
+	return 1
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// buckets holds the token buckets per app port, apart from the App values
+// so they survive app reloads
+var buckets = struct {
+	sync.Mutex
+	m map[int]*tokenBucket
+}{m: make(map[int]*tokenBucket)}
+
+// allow charges the request's cost to the app's limit. It reports what is left
+// and when that changes: for a bucket, how long until it is full again; for a
+// sliding window, until its oldest request leaves the window. A rejected
+// request gets how long until it could be admitted.
+func (rl *RateLimit) allow(port int, r *http.Request, p string, now time.Time) (ok bool, remaining float64, reset time.Duration) {
+	cost := rl.cost(r.Method, p)
+	if rl.slidingWindow() {
+		return rl.allowWindow(port, cost, now)
+	}
+	burst := rl.burst()
+
+	buckets.Lock()
+	defer buckets.Unlock()
+	b, found := buckets.m[port]
+	if !found {
+		b = &tokenBucket{tokens: burst, last: now}
+		buckets.m[port] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rl.Rate)
+	b.last = now
+
+	if b.tokens < cost {
+		return false, b.tokens, rl.refill(cost - b.tokens)
+	}
+	b.tokens -= cost
+	return true, b.tokens, rl.refill(burst - b.tokens)
+}
+
+// refill is how long the bucket takes to gain n tokens
+func (rl *RateLimit) refill(n float64) time.Duration {
+	if rl.Rate <= 0 {
+		return 0
+	}
+	return time.Duration(n / rl.Rate * float64(time.Second))
+}
+
+// windowEntry is a request admitted by a sliding window
+type windowEntry struct {
+	at   time.Time
+	cost float64
+}
+
+// windowLog holds the requests admitted in the current window, oldest first
+type windowLog struct {
+	entries []windowEntry
+	total   float64
+}
+
+var windows = struct {
+	sync.Mutex
+	m map[int]*windowLog
+}{m: make(map[int]*windowLog)}
+
+func (rl *RateLimit) allowWindow(port int, cost float64, now time.Time) (ok bool, remaining float64, reset time.Duration) {
+	window := time.Duration(rl.WindowMS) * time.Millisecond
+	limit := float64(rl.Limit)
+
+	windows.Lock()
+	defer windows.Unlock()
+	l, found := windows.m[port]
+	if !found {
+		l = &windowLog{}
+		windows.m[port] = l
+	}
+	// Evict what has left the window
+	n := 0
+	for n < len(l.entries) && !l.entries[n].at.After(now.Add(-window)) {
+		l.total -= l.entries[n].cost
+		n++
+	}
+	l.entries = l.entries[n:]
+
+	if l.total+cost > limit {
+		// Wait for enough of the oldest requests to leave the window
+		need := l.total + cost - limit
+		for _, e := range l.entries {
+			need -= e.cost
+			if need <= 0 {
+				return false, limit - l.total, e.at.Add(window).Sub(now)
+			}
+		}
+	}
+	l.entries = append(l.entries, windowEntry{at: now, cost: cost})
+	l.total += cost
+	return true, limit - l.total, l.entries[0].at.Add(window).Sub(now)
+}
+
+// rateLimit applies the app's rate limit to r, writing 429 when it is used
+// up. It reports whether the request may proceed; requests for
+// LIMIT_BYPASS_PATHS always may.
+func rateLimit(w http.ResponseWriter, r *http.Request, port int, app *App, p string) bool {
+	if app == nil || app.RateLimit == nil || !app.RateLimit.enabled() || bypassesLimits(r) {
+		return true
+	}
+	rl := app.RateLimit
+	ok, remaining, reset := rl.allow(port, r, p, time.Now())
+	resetSecs := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+	w.Header().Set("X-RateLimit-Limit", strconv.FormatFloat(rl.burst(), 'f', -1, 64))
+	w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(int(remaining)))
+	w.Header().Set("X-RateLimit-Reset", resetSecs)
+	if !ok {
+		rateLimited.WithLabelValues(strconv.Itoa(port)).Inc()
+		countShed(port, shedRateLimit)
+		w.Header().Set("Retry-After", resetSecs)
+		http.Error(w, "Rate limit exceeded for this application", http.StatusTooManyRequests)
+		return false
+	}
+	return true
+}
+
+// validate warns about settings the limiter cannot honour
+func (rl *RateLimit) validate(port int) {
+	if !rl.knownAlgorithm() {
+		log.Printf("Unknown rate limit algorithm %q for app %d, using %s", rl.Algorithm, port, algorithmBucket)
+	}
+	if !rl.enabled() {
+		log.Printf("Rate limit for app %d is incomplete and disabled", port)
+	}
+}
+
+func (rl *RateLimit) knownAlgorithm() bool {
+	switch rl.Algorithm {
+	case "", algorithmBucket, algorithmSlidingWindow:
+		return true
+	}
+	return false
+}
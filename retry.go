@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isIdempotent reports whether repeating the request has the same effect as
+// sending it once (RFC 9110 section 9.2.2), so it is safe to retry. WebDAV
+// methods follow the IANA method registry; POST, PATCH, LOCK and unknown
+// methods are never retried.
+func isIdempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace,
+		http.MethodPut, http.MethodDelete,
+		"PROPFIND", "PROPPATCH", "MKCOL", "COPY", "MOVE", "UNLOCK", "REPORT", "SEARCH":
+		return true
+	}
+	return false
+}
+
+// bufferBody reads r's body into memory so every attempt can send it again
+// via r.GetBody. It reports false, leaving the body streaming, when the body
+// is larger than limit; such requests are not retried. Chunked bodies have no
+// length to check up front, so at most limit bytes of them are held back
+// before the rest streams through.
+func bufferBody(r *http.Request, limit int64) (bool, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return true, nil
+	}
+	if r.ContentLength > limit {
+		return false, nil
+	}
+	orig := r.Body
+	buf, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if err != nil {
+		return false, err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), orig), orig}
+		return false, nil
+	}
+	orig.Close()
+	r.ContentLength = int64(len(buf))
+	r.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(buf)), nil
+	}
+	r.Body, _ = r.GetBody()
+	return true, nil
+}
+
+// shouldRetry reports whether an attempt failed in a way another attempt may
+// fix: a transport error other than the client going away, the body being
+// too large or a loop, or a 502/503/504 from the backend.
+func shouldRetry(resp *http.Response, err error) bool {
+	if err != nil {
+		var maxBytesErr *http.MaxBytesError
+		return !errors.As(err, &maxBytesErr) && !errors.Is(err, context.Canceled) && !errors.Is(err, errLoop)
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// retryDelay is how long to wait before the next attempt. A 503 with a
+// Retry-After header is honored as sent unless it asks for more than limit,
+// in which case it reports false and no retry is made; otherwise the delay
+// doubles from RETRY_BACKOFF each attempt, up to limit. A zero limit means
+// none.
+func retryDelay(resp *http.Response, attempt int, limit time.Duration) (time.Duration, bool) {
+	if resp != nil && resp.StatusCode == http.StatusServiceUnavailable {
+		if d, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok {
+			return d, limit <= 0 || d <= limit
+		}
+	}
+	d := config.RetryBackoff << (attempt - 1)
+	if limit > 0 && (d > limit || d < config.RetryBackoff) {
+		// d < RetryBackoff when the shift overflowed
+		d = limit
+	}
+	return d, true
+}
+
+// retryMaxDelay is the longest t's requests wait before a retry:
+// RETRY_MAX_DELAY, or else the upstream timeout of an attempt
+func retryMaxDelay(t proxyTarget) time.Duration {
+	if config.RetryMaxDelay > 0 {
+		return config.RetryMaxDelay
+	}
+	return t.timeout
+}
+
+// parseRetryAfter accepts both the delay-seconds and the HTTP-date form
+func parseRetryAfter(v string, now time.Time) (time.Duration, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	t, err := http.ParseTime(v)
+	if err != nil {
+		return 0, false
+	}
+	if d := t.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
+
+// waitRetry sleeps for delay unless ctx is done first. It refuses to wait at
+// all when the delay would run past the context deadline, since the request
+// would fail before the next attempt anyway.
+func waitRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetryDelay(t *testing.T) {
+	config.RetryBackoff = 100 * time.Millisecond
+	busy := func(retryAfter string) *http.Response {
+		resp := &http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}}
+		resp.Header.Set("Retry-After", retryAfter)
+		return resp
+	}
+	tests := []struct {
+		name    string
+		resp    *http.Response
+		attempt int
+		limit   time.Duration
+		want    time.Duration
+		wantOK  bool
+	}{
+		{"backoff", nil, 3, time.Second, 400 * time.Millisecond, true},
+		{"backoff capped", nil, 10, time.Second, time.Second, true},
+		{"backoff overflow", nil, 60, time.Second, time.Second, true},
+		{"retry-after", busy("1"), 1, 5 * time.Second, time.Second, true},
+		{"retry-after past limit", busy("3600"), 1, 5 * time.Second, time.Hour, false},
+		{"no limit", busy("3600"), 1, 0, time.Hour, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := retryDelay(tt.resp, tt.attempt, tt.limit)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("retryDelay = %s, %v, want %s, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestLongRetryAfterNotWaited(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRIES", "2")
+	t.Setenv("RETRY_MAX_DELAY", "1s")
+	var hits atomic.Int32
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	gw := startGateway(t, appDoc(port))
+
+	start := time.Now()
+	resp, _ := get(t, gw, fmt.Sprintf("/%d/", port))
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want 503", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "3600" {
+		t.Errorf("Retry-After = %q, want the backend's", got)
+	}
+	if n := hits.Load(); n != 1 {
+		t.Errorf("backend hit %d times, want 1", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("took %s, the Retry-After was waited for", elapsed)
+	}
+}
+
+func TestRetryReplaysBufferedBody(t *testing.T) {
+	t.Setenv("UPSTREAM_RETRIES", "1")
+	t.Setenv("RETRY_BACKOFF", "1ms")
+	t.Setenv("RETRY_MAX_BODY", "16")
+	tests := []struct {
+		name     string
+		body     string
+		status   int
+		attempts int32
+	}{
+		{"small body", "hello", http.StatusOK, 2},
+		{"large body", strings.Repeat("x", 64), http.StatusBadGateway, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int32
+			port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+				if string(body) != tt.body {
+					t.Errorf("attempt %d got body %q", hits.Load()+1, body)
+				}
+				if hits.Add(1) == 1 {
+					w.WriteHeader(http.StatusBadGateway)
+				}
+			})
+			gw := startGateway(t, appDoc(port))
+
+			req, _ := http.NewRequest(http.MethodPut, fmt.Sprintf("%s/%d/", gw.URL, port), strings.NewReader(tt.body))
+			resp, _ := do(t, req)
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if n := hits.Load(); n != tt.attempts {
+				t.Errorf("backend hit %d times, want %d", n, tt.attempts)
+			}
+		})
+	}
+}
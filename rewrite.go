@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// RewriteRule replaces every match of the regular expression Pattern in a
+// body with Replace, which may refer to groups as $1 or ${name}
+type RewriteRule struct {
+	Pattern string `bson:"pattern"`
+	Replace string `bson:"replace"`
+}
+
+type compiledRewrite struct {
+	re      *regexp.Regexp
+	replace []byte
+}
+
+func compileRewrites(port int, rules []RewriteRule) []compiledRewrite {
+	var out []compiledRewrite
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			log.Printf("Skipping invalid rewrite pattern %q for app %d: %v", rule.Pattern, port, err)
+			continue
+		}
+		out = append(out, compiledRewrite{re: re, replace: []byte(rule.Replace)})
+	}
+	return out
+}
+
+// isTextContent reports whether a body of the content type can be rewritten
+// as text. Binary types are left alone.
+func isTextContent(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	switch {
+	case strings.HasPrefix(mt, "text/"),
+		mt == "application/json", mt == "application/javascript", mt == "application/xml",
+		strings.HasSuffix(mt, "+json"), strings.HasSuffix(mt, "+xml"):
+		return true
+	}
+	return false
+}
+
+// rewriteResponseBody applies the app's response rewrite rules to resp's
+// body. Only uncompressed text bodies up to REWRITE_MAX_BODY are rewritten;
+// a larger body is detected while buffering and streamed through unchanged.
+func rewriteResponseBody(app *App, resp *http.Response) {
+	if app == nil || len(app.responseRewrites) == 0 || !isTextContent(resp.Header.Get("Content-Type")) {
+		return
+	}
+	if ce := resp.Header.Get("Content-Encoding"); ce != "" && ce != "identity" {
+		return
+	}
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		// No body, and Content-Length must keep describing the GET response
+		return
+	}
+	if resp.StatusCode == http.StatusPartialContent {
+		// Rewriting a slice would break its Content-Range
+		return
+	}
+	limit := config.RewriteMaxBody
+	if resp.ContentLength > limit {
+		return
+	}
+
+	orig := resp.Body
+	buf, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if err != nil || int64(len(buf)) > limit {
+		// Hand back what was read followed by the rest of the stream
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), orig), orig}
+		return
+	}
+
+	for _, rw := range app.responseRewrites {
+		buf = rw.re.ReplaceAll(buf, rw.replace)
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(buf))
+	resp.ContentLength = int64(len(buf))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(buf)))
+}
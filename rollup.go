@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UsageBucket is an app's usage by one tenant ("" for the default) within
+// the hour starting at Hour. Buckets are kept with USAGE_HISTORY so usage
+// can be rolled up over a time range.
+type UsageBucket struct {
+	Port     int       `bson:"port"`
+	Tenant   string    `bson:"tenant"`
+	Hour     time.Time `bson:"hour"`
+	Count    int       `bson:"count"`
+	BytesIn  int64     `bson:"bytes_in"`
+	BytesOut int64     `bson:"bytes_out"`
+}
+
+type bucketKey struct {
+	port   int
+	tenant string
+	hour   time.Time
+}
+
+// usageHistory gathers the usage since the last flush. Unlike the counters
+// the buckets are written as increments, so a failed flush keeps its
+// increments for the next one.
+var usageHistory = struct {
+	sync.Mutex
+	m map[bucketKey]*UsageBucket
+}{m: make(map[bucketKey]*UsageBucket)}
+
+// historyFlushInterval is how often the gathered usage is written
+const historyFlushInterval = 10 * time.Second
+
+// recordHistory adds a request to its hourly bucket
+func recordHistory(port int, tenant string, in, out int64, now time.Time) {
+	k := bucketKey{port, tenant, now.UTC().Truncate(time.Hour)}
+	usageHistory.Lock()
+	b, ok := usageHistory.m[k]
+	if !ok {
+		b = &UsageBucket{Port: port, Tenant: tenant, Hour: k.hour}
+		usageHistory.m[k] = b
+	}
+	b.Count++
+	b.BytesIn += in
+	b.BytesOut += out
+	usageHistory.Unlock()
+}
+
+// watchUsageHistory writes the gathered usage to the store every
+// historyFlushInterval
+func watchUsageHistory(store UsageStore) {
+	for range time.Tick(historyFlushInterval) {
+		flushHistory(store)
+	}
+}
+
+// flushHistory writes the gathered usage in batches of
+// USAGE_HISTORY_BATCH_SIZE buckets, USAGE_HISTORY_FLUSH_CONCURRENCY at a
+// time. Every bucket is in exactly one batch and is written as an
+// increment, so the batches may land in any order.
+func flushHistory(store UsageStore) {
+	usageHistory.Lock()
+	gathered := usageHistory.m
+	usageHistory.m = make(map[bucketKey]*UsageBucket)
+	usageHistory.Unlock()
+	if len(gathered) == 0 {
+		return
+	}
+
+	buckets := make([]*UsageBucket, 0, len(gathered))
+	for _, b := range gathered {
+		buckets = append(buckets, b)
+	}
+	slots := make(chan struct{}, config.UsageHistoryFlushConcurrency)
+	var wg sync.WaitGroup
+	for start := 0; start < len(buckets); start += config.UsageHistoryBatchSize {
+		batch := buckets[start:min(start+config.UsageHistoryBatchSize, len(buckets))]
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writeHistory(store, batch)
+			<-slots
+		}()
+	}
+	wg.Wait()
+}
+
+// writeHistory writes a batch of buckets, putting back those that were not
+// written for the next flush. Only they are retried, so no increment is
+// applied twice.
+func writeHistory(store UsageStore, batch []*UsageBucket) {
+	ctx, cancel := context.WithTimeout(context.Background(), usageWriteTimeout)
+	defer cancel()
+	err := store.AddUsageHistory(ctx, batch)
+	if err == nil {
+		return
+	}
+	failed := batch
+	var unwritten *unwrittenBuckets
+	if errors.As(err, &unwritten) {
+		failed = unwritten.buckets
+	}
+	log.Printf("Error writing %d of %d usage history buckets, retrying with the next flush: %v", len(failed), len(batch), err)
+	// Merged back into what was gathered meanwhile
+	usageHistory.Lock()
+	for _, b := range failed {
+		k := bucketKey{b.Port, b.Tenant, b.Hour}
+		if cur, ok := usageHistory.m[k]; ok {
+			cur.Count += b.Count
+			cur.BytesIn += b.BytesIn
+			cur.BytesOut += b.BytesOut
+		} else {
+			usageHistory.m[k] = b
+		}
+	}
+	usageHistory.Unlock()
+}
+
+// unwrittenBuckets is returned by AddUsageHistory when it knows that only
+// some of the buckets were not written
+type unwrittenBuckets struct {
+	buckets []*UsageBucket
+	err     error
+}
+
+func (e *unwrittenBuckets) Error() string { return e.err.Error() }
+func (e *unwrittenBuckets) Unwrap() error { return e.err }
+
+// RollupQuery selects and groups usage for a rollup. Group is "total",
+// "app", "tenant" or "hour". With From or To set the hourly buckets in that
+// range are rolled up, which needs USAGE_HISTORY; otherwise the all-time
+// counters are. Rows are sorted by count, highest first (by hour for
+// "hour"), and Top, when positive, keeps that many.
+type RollupQuery struct {
+	Group    string
+	From, To time.Time
+	Tenant   string
+	Top      int
+}
+
+func (q RollupQuery) ranged() bool {
+	return !q.From.IsZero() || !q.To.IsZero()
+}
+
+// errRollupUnsupported is returned by stores that can't aggregate
+var errRollupUnsupported = errors.New("rollups need STORAGE=mongo")
+
+// rollupHandler streams usage rollups computed by the store as a JSON array
+// (GET /admin/usage/rollup?group=app&from=...&to=...&tenant=...&top=N).
+// from and to are RFC 3339 times; the range includes from and excludes to.
+func rollupHandler(store UsageStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		q := RollupQuery{Group: query.Get("group"), Tenant: query.Get("tenant")}
+		if q.Group == "" {
+			q.Group = "app"
+		}
+		switch q.Group {
+		case "total", "app", "tenant", "hour":
+		default:
+			jsonError(w, http.StatusBadRequest, "group must be total, app, tenant or hour")
+			return
+		}
+		for name, t := range map[string]*time.Time{"from": &q.From, "to": &q.To} {
+			if v := query.Get(name); v != "" {
+				parsed, err := time.Parse(time.RFC3339, v)
+				if err != nil {
+					jsonError(w, http.StatusBadRequest, "Invalid "+name+": must be an RFC 3339 time")
+					return
+				}
+				*t = parsed
+			}
+		}
+		if v := query.Get("top"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				jsonError(w, http.StatusBadRequest, "Invalid top: must be a positive number")
+				return
+			}
+			q.Top = n
+		}
+		if (q.ranged() || q.Group == "hour") && !config.UsageHistory {
+			jsonError(w, http.StatusBadRequest, "Time ranges need USAGE_HISTORY")
+			return
+		}
+		if q.Group == "hour" && !q.ranged() {
+			jsonError(w, http.StatusBadRequest, "group=hour needs from or to")
+			return
+		}
+
+		// Rows are written as the store reads them; the status is only sent
+		// with the first, so a failing pipeline can still answer an error
+		enc := json.NewEncoder(w)
+		rows := 0
+		err := store.Rollup(r.Context(), q, func(row map[string]any) error {
+			sep := ","
+			if rows == 0 {
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusOK)
+				sep = "["
+			}
+			rows++
+			if _, err := w.Write([]byte(sep)); err != nil {
+				return err
+			}
+			return enc.Encode(row)
+		})
+		switch {
+		case rows > 0:
+			if err != nil {
+				// Too late for an error status; the array is left unclosed so
+				// the client sees invalid JSON rather than a short result
+				log.Printf("Error streaming usage rollup: %v", err)
+				return
+			}
+			w.Write([]byte("]\n"))
+		case errors.Is(err, errRollupUnsupported):
+			jsonError(w, http.StatusNotImplemented, err.Error())
+		case err != nil:
+			log.Printf("Error computing usage rollup: %v", err)
+			jsonError(w, http.StatusInternalServerError, "Error computing usage rollup")
+		default:
+			writeJSON(w, http.StatusOK, []any{})
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// PrefixRoute sends requests whose path matches Pattern to the app on Port.
+// A trailing "*" makes Pattern a prefix match; otherwise the path must match
+// exactly.
+type PrefixRoute struct {
+	Pattern string
+	Port    int
+}
+
+// prefixRoute returns the first of PREFIX_ROUTES matching the path
+func prefixRoute(p string) (PrefixRoute, bool) {
+	for _, pr := range config.PrefixRoutes {
+		if matchPath(pr.Pattern, p) {
+			return pr, true
+		}
+	}
+	return PrefixRoute{}, false
+}
+
+// requestAppID returns the app ID a proxied request is addressed to. With
+// ROUTE_BY=path a numeric first segment is the app ID; otherwise the first
+// matching PREFIX_ROUTES rule, in the order given, names the app; otherwise
+// the first segment is returned as is and the request goes to
+// DEFAULT_BACKEND. With ROUTE_BY=header it is the ROUTE_HEADER header and ok
+// is false when that is missing.
+func requestAppID(r *http.Request) (id string, ok bool) {
+	if config.RouteBy == "header" {
+		id = strings.TrimSpace(r.Header.Get(config.RouteHeader))
+		return id, id != ""
+	}
+	id = chi.URLParam(r, "appID")
+	if _, err := strconv.Atoi(id); err != nil {
+		if pr, ok := prefixRoute(routePath(r)); ok {
+			return strconv.Itoa(pr.Port), true
+		}
+	}
+	return id, true
+}
+
+// requestAppPath returns the path of a request relative to its app, as route
+// limits and rate limit costs match it. With ROUTE_BY=header, and for
+// requests matched by PREFIX_ROUTES, that is the whole path, which is also
+// what the backend gets.
+func requestAppPath(r *http.Request) string {
+	if config.RouteBy == "header" {
+		return routePath(r)
+	}
+	if _, err := strconv.Atoi(chi.URLParam(r, "appID")); err != nil {
+		return routePath(r)
+	}
+	return "/" + chi.URLParam(r, "*")
+}
+
+// ContentRoute sends requests whose Header (Content-Type by default, or
+// Accept) matches Pattern to Upstream instead of the app's default instance.
+// Pattern is a media type and may use a "type/*" wildcard, e.g. "multipart/*".
+type ContentRoute struct {
+	Header   string `bson:"header,omitempty"`
+	Pattern  string `bson:"pattern"`
+	Upstream string `bson:"upstream"`
+}
+
+func (cr ContentRoute) matches(r *http.Request) bool {
+	header := cr.Header
+	if header == "" {
+		header = "Content-Type"
+	}
+	// Accept may list several media types; any of them can match
+	for _, v := range strings.Split(r.Header.Get(header), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(v))
+		if err != nil {
+			continue
+		}
+		if matchMediaType(cr.Pattern, mt) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchMediaType(pattern, mt string) bool {
+	pattern = strings.ToLower(pattern)
+	if prefix, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return strings.HasPrefix(mt, prefix+"/")
+	}
+	return pattern == mt
+}
+
+// selectUpstream picks the host:port a request for the app on port is sent
+// to. Content routes are evaluated first, in order, then version routing,
+// then geo routing, then the A/B experiment; without a match (or without a
+// registered app) the app's Balancer picks an instance of its pool, leaving
+// out those failing health checks. It returns "" when the pool is empty.
+func selectUpstream(app *App, port int, r *http.Request) string {
+	if app != nil {
+		for _, cr := range app.ContentRoutes {
+			if cr.matches(r) {
+				return cr.Upstream
+			}
+		}
+		if app.VersionRouting != nil {
+			if _, upstream, ok := app.VersionRouting.resolve(r); ok {
+				return upstream
+			}
+		}
+		if app.GeoRouting != nil {
+			if upstream, ok := app.GeoRouting.resolve(r); ok {
+				return upstream
+			}
+		}
+		if app.Experiment != nil {
+			if upstream, ok := app.Experiment.upstream(r); ok {
+				return upstream
+			}
+		}
+	}
+	balancer := Balancer(roundRobinBalancer{port})
+	if app != nil && app.balancer != nil {
+		balancer = app.balancer
+	}
+	in, err := balancer.Pick(r, healthyInstances(app, port, appInstances(app, port)))
+	if err != nil {
+		return ""
+	}
+	return in.Addr
+}
+
+// VersionRouting maps an API version read from a request header to an
+// upstream instance. Requests with a missing or unknown version use Default
+// (itself a key of Upstreams); when that is empty too they fall through to
+// the app's default instance.
+type VersionRouting struct {
+	Header    string            `bson:"header,omitempty"`
+	Upstreams map[string]string `bson:"upstreams"`
+	Default   string            `bson:"default,omitempty"`
+}
+
+// resolve returns the effective version for the request and its upstream.
+func (vr *VersionRouting) resolve(r *http.Request) (version, upstream string, ok bool) {
+	header := vr.Header
+	if header == "" {
+		header = "X-API-Version"
+	}
+	version = strings.TrimSpace(r.Header.Get(header))
+	if upstream, ok = vr.Upstreams[version]; ok {
+		return version, upstream, true
+	}
+	upstream, ok = vr.Upstreams[vr.Default]
+	return vr.Default, upstream, ok
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestAppIDStatus(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+	gw := startGateway(t, appDoc(port))
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		// Not an app ID, so a path for DEFAULT_BACKEND, which is not set
+		{"/notanumber/", http.StatusNotFound},
+		{"/0/", http.StatusBadRequest},
+		{"/99999/", http.StatusNotFound},
+		{fmt.Sprintf("/%d/", port), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			resp, body := get(t, gw, tt.path)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if resp.StatusCode != http.StatusOK {
+				var v map[string]any
+				if err := json.Unmarshal([]byte(body), &v); err != nil || v["error"] == nil {
+					t.Errorf("body %q is not a JSON error", body)
+				}
+			}
+		})
+	}
+}
+
+func TestOverlappingPrefixRoutes(t *testing.T) {
+	backend := func(name string) int {
+		return startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprintf(w, "%s %s", name, r.URL.Path)
+		})
+	}
+	users, api := backend("users"), backend("api")
+
+	tests := []struct {
+		name   string
+		routes string
+		path   string
+		want   string
+	}{
+		{"longer first", "/api/v1/users/*=%[1]d,/api/v1/*=%[2]d", "/api/v1/users/5", "users /api/v1/users/5"},
+		{"longer first, other path", "/api/v1/users/*=%[1]d,/api/v1/*=%[2]d", "/api/v1/orders", "api /api/v1/orders"},
+		// Rules are tried in the order given, so the shorter prefix shadows
+		{"shorter first", "/api/v1/*=%[2]d,/api/v1/users/*=%[1]d", "/api/v1/users/5", "api /api/v1/users/5"},
+		{"exact", "/api/v1/users=%[1]d,/api/v1/*=%[2]d", "/api/v1/users", "users /api/v1/users"},
+		{"exact is not a prefix", "/api/v1/users=%[1]d,/api/*=%[2]d", "/api/v1/users/5", "api /api/v1/users/5"},
+		// A numeric first segment is an app ID before any rule
+		{"app ID wins", "/*=%[2]d", fmt.Sprintf("/%d/x", users), fmt.Sprintf("users /%d/x", users)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("PREFIX_ROUTES", fmt.Sprintf(tt.routes, users, api))
+			gw := startGateway(t, appDoc(users), appDoc(api))
+			resp, body := get(t, gw, tt.path)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, body)
+			}
+			if body != tt.want {
+				t.Errorf("got %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
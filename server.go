@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Server is the gateway's HTTP handler, with the apps and keys loaded from
+// its store. It serves the proxy routes, /metrics and, unless ADMIN_PORT is
+// set, the admin API.
+type Server struct {
+	store  UsageStore
+	router chi.Router
+	// admin is the router for the ADMIN_PORT listener, nil without one
+	admin chi.Router
+}
+
+// NewServer sets cfg as the gateway config, loads the apps and API keys from
+// store and builds the routes. Background work (reloads, log export) and the
+// listeners are left to the caller.
+func NewServer(cfg Config, store UsageStore) (*Server, error) {
+	config = cfg
+	setupLoopDetection()
+	upstreamClient = newUpstreamClient()
+	responses.max = config.CacheMaxEntries
+	registerLatencyMetrics()
+
+	if config.ErrorPagesDir != "" {
+		pages, err := loadErrorPages(config.ErrorPagesDir)
+		if err != nil {
+			return nil, fmt.Errorf("loading error pages: %w", err)
+		}
+		errorPages = pages
+	}
+	if config.GeoIPDB != "" {
+		if err := openGeoIP(config.GeoIPDB); err != nil {
+			return nil, fmt.Errorf("opening GeoIP database: %w", err)
+		}
+	}
+	if err := checkDisabledMiddlewares(); err != nil {
+		return nil, err
+	}
+
+	if err := loadFromStore(store); err != nil {
+		return nil, err
+	}
+	if config.WarmupConns > 0 {
+		go warmUpstreams()
+	}
+
+	s := &Server{store: store}
+	registerMethods(config.ExtraMethods)
+	r := chi.NewRouter()
+	r.Use(routerMiddlewares(false)...)
+	// Set before mounting, so mounted routers inherit them
+	r.NotFound(routeNotFound)
+	r.MethodNotAllowed(methodNotAllowed)
+	// With BASE_PATH the routes live on a router mounted under it; chi strips
+	// the prefix from the routing path, which is what is resolved and
+	// forwarded
+	routes := chi.Router(r)
+	if config.BasePath != "" {
+		routes = chi.NewRouter()
+		r.Mount(config.BasePath, routes)
+	}
+
+	routes.Handle("/metrics", promhttp.Handler())
+	routes.Get("/ready", readyHandler)
+	routes.Get("/version", versionHandler)
+
+	// Management API, on its own listener when ADMIN_PORT is set
+	admin := adminRouter(store)
+	if config.AdminPort != "" {
+		ar := chi.NewRouter()
+		ar.Use(routerMiddlewares(true)...)
+		ar.NotFound(routeNotFound)
+		ar.MethodNotAllowed(methodNotAllowed)
+		ar.Get("/version", versionHandler)
+		ar.Mount("/admin", admin)
+		if config.Pprof {
+			mountProfiler(ar)
+		}
+		s.admin = ar
+	} else {
+		routes.Mount("/admin", admin)
+		if config.Pprof {
+			mountProfiler(routes)
+		}
+	}
+
+	routes.Group(func(r chi.Router) {
+		r.Use(proxyMiddlewares()...)
+		if config.RouteBy == "header" {
+			r.HandleFunc("/*", s.serveApp)
+			return
+		}
+		// serveApp hands "/" to serveDefault unless a prefix route matches
+		r.HandleFunc("/", s.serveApp)
+		r.HandleFunc("/{appID}", s.serveApp)
+		r.HandleFunc("/{appID}/*", s.serveApp)
+	})
+	s.router = r
+	return s, nil
+}
+
+// routeNotFound answers requests no route matches in the gateway's JSON
+// error format
+func routeNotFound(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusNotFound, map[string]string{
+		"error":      "Not found",
+		"request_id": middleware.GetReqID(r.Context()),
+	})
+}
+
+// methodNotAllowed answers requests whose route exists but not with their
+// method. chi only sets Allow in its own 405 handler, so it is worked out
+// here.
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	if allowed := allowedMethods(r); len(allowed) > 0 {
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+	}
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]string{
+		"error":      "Method not allowed",
+		"request_id": middleware.GetReqID(r.Context()),
+	})
+}
+
+// storeLoadTimeout bounds each of the reads from the store at startup. They
+// get a context of their own, apart from the store's connection, which
+// lives until shutdown.
+var storeLoadTimeout = 20 * time.Second
+
+// loadFromStore reads the apps with their counts, the tenant usage and the
+// API keys into memory
+func loadFromStore(store UsageStore) error {
+	ctx, cancel := context.WithTimeout(context.Background(), storeLoadTimeout)
+	apps, err := store.LoadApps(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("retrieving counts: %w", err)
+	}
+	// Once published the map may be written to, so it is only read before
+	syncDiscovery(apps)
+
+	ctx, cancel = context.WithTimeout(context.Background(), storeLoadTimeout)
+	usage, err := store.LoadTenantUsage(ctx)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("retrieving tenant usage: %w", err)
+	}
+	usageData.Lock()
+	usageData.Apps = apps
+	for _, u := range usage {
+		tenantUsage[u.key()] = u
+	}
+	usageData.Unlock()
+
+	ctx, cancel = context.WithTimeout(context.Background(), storeLoadTimeout)
+	defer cancel()
+	if err := loadAPIKeys(ctx, store); err != nil {
+		return fmt.Errorf("retrieving API keys: %w", err)
+	}
+	return nil
+}
+
+// ServeHTTP serves the main listener's routes
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.router.ServeHTTP(w, r)
+}
+
+// AdminHandler returns the admin API for the ADMIN_PORT listener, nil when
+// it is served by the Server itself
+func (s *Server) AdminHandler() http.Handler {
+	if s.admin == nil {
+		return nil
+	}
+	return s.admin
+}
+
+// serveApp proxies a request to a backend application. The app ID, taken
+// from the path or a header (see requestAppID), is the port of the app's
+// default instance; unregistered apps get 404 unless DEFAULT_BACKEND or
+// AUTO_REGISTER is set. An allowed upstream override skips all of that (see
+// upstreamOverride).
+func (s *Server) serveApp(w http.ResponseWriter, r *http.Request) {
+	override, status, msg := upstreamOverride(r)
+	if status != 0 {
+		jsonError(w, status, msg)
+		return
+	}
+	if override != "" {
+		// Sent as is, like requests for DEFAULT_BACKEND, without app or usage
+		proxyRequest(proxyTarget{
+			upstream: override,
+			timeout:  config.UpstreamTimeout,
+			maxBody:  config.MaxBodySize,
+		}, w, r)
+		return
+	}
+	appID, ok := requestAppID(r)
+	if !ok {
+		jsonError(w, http.StatusBadRequest, "Missing "+config.RouteHeader+" header")
+		return
+	}
+	port, err := strconv.Atoi(appID)
+	if err != nil {
+		serveDefault(w, r)
+		return
+	}
+	if port < 1 {
+		jsonError(w, http.StatusBadRequest, "Invalid application ID")
+		return
+	}
+
+	usageData.Lock()
+	app := usageData.Apps[port]
+	usageData.Unlock()
+	if app == nil {
+		switch {
+		case config.DefaultBackend != "":
+			serveDefault(w, r)
+			return
+		// Larger IDs are well formed but no app can listen there, so they
+		// are unknown rather than registered
+		case config.AutoRegister && port <= 65535:
+			app = autoRegister(s.store, port)
+		default:
+			jsonError(w, http.StatusNotFound, "Unknown application")
+			return
+		}
+	}
+	setAccessApp(r, app)
+
+	// Only registered apps are counted, so probing unknown ports can't
+	// blow up the metric's cardinality
+	ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+	defer func() { countResponse(port, ww.Status()) }()
+	w = ww
+	if key, ok := apiKeyFromRequest(r); ok && !key.allows(port) {
+		http.Error(w, "API key not allowed for this application", http.StatusForbidden)
+		return
+	}
+
+	usageData.Lock()
+	exhausted := app.overQuota(time.Now())
+	usageData.Unlock()
+	if exhausted {
+		countShed(port, shedQuota)
+		http.Error(w, "Quota exceeded for this application", config.QuotaStatus)
+		return
+	}
+
+	if !checkCSRF(w, r, port, app) {
+		return
+	}
+	appPath := requestAppPath(r)
+	done := timePhase(r, "ratelimit")
+	allowed := rateLimit(w, r, port, app, appPath)
+	done()
+	if !allowed {
+		return
+	}
+
+	limit := 0
+	var queue *PriorityQueueing
+	if app != nil {
+		limit, queue = app.MaxConcurrent, app.Queue
+	}
+	release, ok := acquireSlot(r, port, limit, queue)
+	if !ok {
+		countShed(port, shedConcurrency)
+		http.Error(w, "Too many concurrent requests for this application", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	timeout, maxBody := requestLimits(app, appPath)
+	if app != nil && app.VersionRouting != nil {
+		version, _, _ := app.VersionRouting.resolve(r)
+		w.Header().Set("X-Gateway-API-Version", version)
+	}
+	if app != nil && app.Experiment != nil {
+		assignVariant(w, r, port, app.Experiment)
+	}
+
+	upstream := selectUpstream(app, port, r)
+	if upstream == "" {
+		countUpstreamError(port, upstreamNoInstances)
+		http.Error(w, "No instances available for this application", http.StatusServiceUnavailable)
+		return
+	}
+
+	body := countBody(r)
+	var circuit *breaker
+	cs := circuitSettings(app)
+	if cs.failures > 0 {
+		circuit = breakerFor(port)
+		if !circuit.allow(time.Now(), cs) {
+			countShed(port, shedCircuitOpen)
+			http.Error(w, "Application is unavailable", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	defer trackInstance(upstream)()
+	sent := proxyRequest(proxyTarget{
+		port:     port,
+		app:      app,
+		upstream: upstream,
+		timeout:  timeout,
+		maxBody:  maxBody,
+	}, w, r)
+	switch {
+	case circuit == nil:
+	case !sent:
+		// Cache hits and the like say nothing about the backend
+		circuit.release()
+	default:
+		failure := ""
+		if ww.Status() >= 500 {
+			failure = fmt.Sprintf("%d from %s", ww.Status(), upstream)
+		}
+		circuit.record(failure, time.Now(), cs)
+	}
+	bytesOut := int64(ww.BytesWritten())
+	countBytes(port, body.n, bytesOut)
+
+	// Increment usage count
+	usageData.Lock()
+	if app, ok := usageData.Apps[port]; ok {
+		app.Count++
+		app.rollCycle(time.Now())
+		app.CycleCount++
+		app.BytesIn += body.n
+		app.BytesOut += bytesOut
+		addUsage(app, body.n, bytesOut)
+		tenant := requestTenant(r)
+		if tenant != "" {
+			countTenant(tenant, port, body.n, bytesOut)
+		}
+		if config.UsageHistory {
+			recordHistory(port, tenant, body.n, bytesOut, time.Now())
+		}
+	} else {
+		log.Printf("App for port %d not found", port)
+	}
+	usageData.Unlock()
+}
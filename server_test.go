@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const testAdminToken = "test-admin-token"
+
+// startBackend serves h on a local port and returns the port. An app
+// registered on that port reaches it through its default localhost
+// instance.
+func startBackend(t *testing.T, h http.HandlerFunc) int {
+	t.Helper()
+	backend := httptest.NewServer(h)
+	t.Cleanup(backend.Close)
+	_, port, err := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := strconv.Atoi(port)
+	return p
+}
+
+// closedPort returns a local port nothing listens on
+func closedPort(t *testing.T) int {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+	return port
+}
+
+// startGateway serves a gateway with in-memory storage over the apps, each
+// an APPS_FILE document. Settings are read from the environment, so tests
+// set them with t.Setenv first.
+func startGateway(t *testing.T, apps ...string) *httptest.Server {
+	t.Helper()
+	return startServer(t, newTestServer(t, apps...))
+}
+
+func startServer(t *testing.T, s *Server) *httptest.Server {
+	t.Helper()
+	gw := httptest.NewServer(s)
+	t.Cleanup(gw.Close)
+	return gw
+}
+
+func newTestServer(t *testing.T, apps ...string) *Server {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "apps.json")
+	if err := os.WriteFile(file, []byte(strings.Join(apps, "\n")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("STORAGE", "memory")
+	if os.Getenv("ADMIN_TOKEN") == "" {
+		t.Setenv("ADMIN_TOKEN", testAdminToken)
+	}
+	s, err := NewServer(loadConfig(), newMemoryStore(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func appDoc(port int) string {
+	return fmt.Sprintf(`{"port": %d}`, port)
+}
+
+// get requests path from the gateway and returns the response with its body
+func get(t *testing.T, gw *httptest.Server, path string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, gw.URL+path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return do(t, req)
+}
+
+func do(t *testing.T, req *http.Request) (*http.Response, string) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func adminGet(t *testing.T, gw *httptest.Server, path string, v any) int {
+	t.Helper()
+	return adminDo(t, gw, http.MethodGet, path, "", v)
+}
+
+// adminDo calls the admin API with the test token, decoding a 2xx JSON
+// answer into v when it is not nil
+func adminDo(t *testing.T, gw *httptest.Server, method, path, body string, v any) int {
+	t.Helper()
+	req, _ := http.NewRequest(method, gw.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	resp, got := do(t, req)
+	if v != nil && resp.StatusCode/100 == 2 {
+		if err := json.Unmarshal([]byte(got), v); err != nil {
+			t.Fatalf("decoding %s: %v", path, err)
+		}
+	}
+	return resp.StatusCode
+}
+
+func TestProxiesToApp(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	})
+	gw := startGateway(t, appDoc(port))
+
+	path := fmt.Sprintf("/%d/users/42", port)
+	resp, body := get(t, gw, path)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if want := "GET " + path; body != want {
+		t.Errorf("backend saw %q, want %q", body, want)
+	}
+	if via := resp.Header.Get("Via"); via == "" {
+		t.Error("no Via header on the response")
+	}
+}
+
+func TestCountsUsage(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	})
+	gw := startGateway(t, appDoc(port))
+
+	for i := 0; i < 3; i++ {
+		get(t, gw, fmt.Sprintf("/%d/", port))
+	}
+	var status appStatus
+	if code := adminGet(t, gw, fmt.Sprintf("/admin/usage/%d", port), &status); code != http.StatusOK {
+		t.Fatalf("usage status = %d", code)
+	}
+	if status.Count != 3 {
+		t.Errorf("count = %d, want 3", status.Count)
+	}
+	if status.BytesOut != 15 {
+		t.Errorf("bytes out = %d, want 15", status.BytesOut)
+	}
+}
+
+func TestUnreachableBackend(t *testing.T) {
+	port := closedPort(t)
+	gw := startGateway(t, appDoc(port))
+
+	resp, body := get(t, gw, fmt.Sprintf("/%d/", port))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("status = %d, want 500: %s", resp.StatusCode, body)
+	}
+	if !strings.Contains(body, "Error forwarding request") {
+		t.Errorf("body = %q", body)
+	}
+}
+
+func TestAdminRequiresToken(t *testing.T) {
+	gw := startGateway(t)
+
+	resp, _ := get(t, gw, "/admin/usage")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("status without token = %d, want 401", resp.StatusCode)
+	}
+	if code := adminGet(t, gw, "/admin/usage", nil); code != http.StatusOK {
+		t.Errorf("status with token = %d, want 200", code)
+	}
+}
+
+func TestUnmatchedRoutesAnswerJSON(t *testing.T) {
+	gw := startGateway(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+	}{
+		{http.MethodGet, "/admin/nonexistent", http.StatusNotFound},
+		{http.MethodDelete, "/admin/usage", http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, gw.URL+tt.path, nil)
+			req.Header.Set("Authorization", "Bearer "+testAdminToken)
+			resp, body := do(t, req)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+				t.Errorf("Content-Type = %q", ct)
+			}
+			var v struct {
+				Error     string `json:"error"`
+				RequestID string `json:"request_id"`
+			}
+			if err := json.Unmarshal([]byte(body), &v); err != nil || v.Error == "" || v.RequestID == "" {
+				t.Errorf("body %q lacks the error or request ID", body)
+			}
+			if tt.status == http.StatusMethodNotAllowed && !strings.Contains(resp.Header.Get("Allow"), http.MethodGet) {
+				t.Errorf("Allow = %q, want GET listed", resp.Header.Get("Allow"))
+			}
+		})
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	})
+	app := fmt.Sprintf(`{"port": %d, "csrf": {}}`, port)
+
+	for _, base := range []string{"", "/gateway"} {
+		t.Run("base="+base, func(t *testing.T) {
+			t.Setenv("BASE_PATH", base)
+			gw := startGateway(t, app)
+
+			for _, path := range []string{"/ready", "/metrics", "/version"} {
+				if resp, body := get(t, gw, base+path); resp.StatusCode != http.StatusOK {
+					t.Errorf("%s%s status = %d: %s", base, path, resp.StatusCode, body)
+				}
+			}
+			if code := adminGet(t, gw, base+"/admin/usage", nil); code != http.StatusOK {
+				t.Errorf("%s/admin/usage status = %d", base, code)
+			}
+
+			resp, body := get(t, gw, fmt.Sprintf("%s/%d/items", base, port))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("proxy status = %d: %s", resp.StatusCode, body)
+			}
+			// The base path is stripped before the app is resolved
+			if want := fmt.Sprintf("/%d/items", port); body != want {
+				t.Errorf("backend saw %q, want %q", body, want)
+			}
+			cookies := resp.Cookies()
+			if len(cookies) != 1 {
+				t.Fatalf("got %d cookies, want the CSRF token", len(cookies))
+			}
+			if want := fmt.Sprintf("%s/%d", base, port); cookies[0].Path != want {
+				t.Errorf("CSRF cookie path = %q, want %q", cookies[0].Path, want)
+			}
+
+			if base != "" {
+				if resp, _ := get(t, gw, "/ready"); resp.StatusCode != http.StatusNotFound {
+					t.Errorf("/ready outside the base path status = %d, want 404", resp.StatusCode)
+				}
+			}
+		})
+	}
+}
+
+func TestCookiePathWithoutAppMount(t *testing.T) {
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	t.Setenv("BASE_PATH", "/gateway")
+	t.Setenv("PREFIX_ROUTES", fmt.Sprintf("/shop/*=%d", port))
+	gw := startGateway(t, fmt.Sprintf(`{"port": %d, "csrf": {}}`, port))
+
+	resp, _ := get(t, gw, "/gateway/shop/cart")
+	cookies := resp.Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want the CSRF token", len(cookies))
+	}
+	if cookies[0].Path != "/gateway" {
+		t.Errorf("CSRF cookie path = %q, want /gateway", cookies[0].Path)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// serverTiming collects how long the gateway's phases of a request took, for
+// the Server-Timing response header (SERVER_TIMING). Phases run more than
+// once, like retried or hedged upstream attempts, are summed.
+type serverTiming struct {
+	mu     sync.Mutex
+	names  []string
+	totals map[string]time.Duration
+}
+
+type serverTimingKey struct{}
+
+// withServerTiming stores a serverTiming on each proxied request so the
+// later stages and the handler can record their phases
+func withServerTiming(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		st := &serverTiming{totals: make(map[string]time.Duration)}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), serverTimingKey{}, st)))
+	})
+}
+
+func (st *serverTiming) add(name string, d time.Duration) {
+	st.mu.Lock()
+	if _, ok := st.totals[name]; !ok {
+		st.names = append(st.names, name)
+	}
+	st.totals[name] += d
+	st.mu.Unlock()
+}
+
+// timePhase starts timing a phase of the request; calling the returned func
+// ends it. It does nothing without SERVER_TIMING.
+func timePhase(r *http.Request, name string) func() {
+	st, ok := r.Context().Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() { st.add(name, time.Since(start)) }
+}
+
+// traceUpstreamConnect records the upstream-connect phase of req, from
+// sending it until it has a connection, pooled or newly dialed
+func traceUpstreamConnect(r, req *http.Request) *http.Request {
+	st, ok := r.Context().Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return req
+	}
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { st.add("upstream-connect", time.Since(start)) },
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+}
+
+// writeServerTiming adds the phases recorded so far as a Server-Timing
+// header, in milliseconds. A backend's own Server-Timing is kept alongside.
+func writeServerTiming(w http.ResponseWriter, r *http.Request) {
+	st, ok := r.Context().Value(serverTimingKey{}).(*serverTiming)
+	if !ok {
+		return
+	}
+	st.mu.Lock()
+	metrics := make([]string, 0, len(st.names))
+	for _, name := range st.names {
+		ms := float64(st.totals[name]) / float64(time.Millisecond)
+		metrics = append(metrics, name+";dur="+strconv.FormatFloat(ms, 'f', 3, 64))
+	}
+	st.mu.Unlock()
+	if len(metrics) > 0 {
+		w.Header().Add("Server-Timing", strings.Join(metrics, ", "))
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var shadowComparisons = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gateway_shadow_comparisons_total",
+	Help: "Primary responses compared with a shadow backend, by result (match, mismatch, error).",
+}, []string{"app", "result"})
+
+// ShadowCompare replays a sample of the app's GET and HEAD requests against
+// a second backend and reports where its responses differ from the primary's.
+// The client always gets the primary response; the shadow request runs in
+// the background.
+type ShadowCompare struct {
+	// Upstream is the host:port of the backend under test
+	Upstream string `bson:"upstream"`
+	// Percent of requests compared (0-100)
+	Percent float64 `bson:"percent"`
+	// MaxBody bounds how many body bytes are compared (default 64KiB)
+	MaxBody int64 `bson:"max_body,omitempty"`
+	// Redact names headers and JSON fields, at any depth, left out of the
+	// comparison, such as timestamps or request IDs
+	Redact []string `bson:"redact,omitempty"`
+}
+
+func (sc *ShadowCompare) maxBody() int64 {
+	if sc.MaxBody > 0 {
+		return sc.MaxBody
+	}
+	return 64 << 10
+}
+
+// volatileHeaders always differ between two responses and are never compared
+var volatileHeaders = []string{"Date", "Content-Length", "X-Request-Id"}
+
+// compareShadow samples the request and, if chosen, captures the start of
+// the primary body and compares it with the shadow backend's response in the
+// background. resp.Body is replaced so the client still gets all of it.
+func compareShadow(t proxyTarget, r *http.Request, resp *http.Response) {
+	sc := t.app.ShadowCompare
+	if sc == nil || sc.Upstream == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return
+	}
+	if rand.Float64()*100 >= sc.Percent {
+		return
+	}
+
+	orig := resp.Body
+	primary, _ := io.ReadAll(io.LimitReader(orig, sc.maxBody()))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(primary), orig), orig}
+
+	status, header := resp.StatusCode, resp.Header.Clone()
+	req := r.Clone(context.Background())
+	go func() {
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if t.timeout > 0 {
+			ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		}
+		defer cancel()
+		label := strconv.Itoa(t.port)
+
+		shadowURL := fmt.Sprintf("http://%s%s", sc.Upstream, routePath(req))
+		sreq, err := http.NewRequestWithContext(ctx, req.Method, shadowURL, nil)
+		if err != nil {
+			shadowComparisons.WithLabelValues(label, "error").Inc()
+			return
+		}
+		sreq.Header = req.Header
+		sresp, err := upstreamClient.Do(sreq)
+		if err != nil {
+			log.Printf("Shadow request for app %d to %s failed: %v", t.port, sc.Upstream, err)
+			shadowComparisons.WithLabelValues(label, "error").Inc()
+			return
+		}
+		defer sresp.Body.Close()
+		rewriteResponseBody(t.app, sresp)
+		shadow, _ := io.ReadAll(io.LimitReader(sresp.Body, sc.maxBody()))
+
+		diffs := sc.diff(status, header, primary, sresp.StatusCode, sresp.Header, shadow)
+		if len(diffs) == 0 {
+			shadowComparisons.WithLabelValues(label, "match").Inc()
+			return
+		}
+		shadowComparisons.WithLabelValues(label, "mismatch").Inc()
+		log.Printf("Shadow response for app %d %s %s differs from primary: %s",
+			t.port, req.Method, routePath(req), strings.Join(diffs, "; "))
+	}()
+}
+
+// diff lists what differs between the primary and shadow responses. Values
+// are not logged, only where they differ.
+func (sc *ShadowCompare) diff(status int, header http.Header, body []byte, sStatus int, sHeader http.Header, sBody []byte) []string {
+	var diffs []string
+	if status != sStatus {
+		diffs = append(diffs, fmt.Sprintf("status %d != %d", status, sStatus))
+	}
+
+	ignored := map[string]bool{}
+	for _, name := range append(volatileHeaders, sc.Redact...) {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	names := map[string]bool{}
+	for name := range header {
+		names[name] = true
+	}
+	for name := range sHeader {
+		names[name] = true
+	}
+	var differing []string
+	for name := range names {
+		if !ignored[name] && strings.Join(header[name], ",") != strings.Join(sHeader[name], ",") {
+			differing = append(differing, name)
+		}
+	}
+	if len(differing) > 0 {
+		sort.Strings(differing)
+		diffs = append(diffs, "headers "+strings.Join(differing, ", "))
+	}
+
+	if !bytes.Equal(sc.redactBody(body), sc.redactBody(sBody)) {
+		diffs = append(diffs, fmt.Sprintf("body (%d vs %d bytes compared)", len(body), len(sBody)))
+	}
+	return diffs
+}
+
+// redactBody drops the redacted fields from a JSON body and re-encodes it so
+// key order and whitespace don't count. Other bodies are compared as is.
+func (sc *ShadowCompare) redactBody(body []byte) []byte {
+	var v any
+	if len(sc.Redact) == 0 || json.Unmarshal(body, &v) != nil {
+		return body
+	}
+	out, err := json.Marshal(redact(v, sc.Redact))
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+func redact(v any, fields []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for _, f := range fields {
+			delete(v, f)
+		}
+		for k, child := range v {
+			v[k] = redact(child, fields)
+		}
+	case []any:
+		for i, child := range v {
+			v[i] = redact(child, fields)
+		}
+	}
+	return v
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// serveUntilSignal serves srv on ln until SIGINT or SIGTERM, then stops
+// accepting and lets in-flight requests finish for up to grace
+// (SHUTDOWN_TIMEOUT). Connections still open after that are closed. It
+// returns the error that stopped srv from serving, if it stopped on its own.
+func serveUntilSignal(srv *http.Server, ln net.Listener, grace time.Duration) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return serveUntil(ctx, srv, ln, grace)
+}
+
+// serveUntil serves srv on ln until ctx is done, then drains it like
+// serveUntilSignal
+func serveUntil(ctx context.Context, srv *http.Server, ln net.Listener, grace time.Duration) error {
+	var open int64
+	srv.ConnState = func(c net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			atomic.AddInt64(&open, 1)
+		case http.StateHijacked, http.StateClosed:
+			atomic.AddInt64(&open, -1)
+		}
+	}
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- srv.Serve(ln) }()
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("Shutting down, draining connections for up to %s", grace)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), grace)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		dropped := atomic.LoadInt64(&open)
+		srv.Close()
+		log.Printf("Drain window elapsed, closed %d remaining connection(s)", dropped)
+		return nil
+	}
+	log.Printf("All connections drained")
+	return nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// SRVDiscovery fills the app's instances from the DNS SRV records of Name,
+// e.g. "_http._tcp.api.internal.", weighted by the records' weights
+type SRVDiscovery struct {
+	Name string `bson:"name"`
+}
+
+// srvFallbackRefresh is used when the record TTL can't be read
+const srvFallbackRefresh = 30 * time.Second
+
+// lookupSRV resolves name and returns the instances of the lowest priority
+// (most preferred) records, together with the smallest TTL among them. The
+// standard resolver hides TTLs, so the query is sent to the first nameserver
+// of /etc/resolv.conf directly, falling back to net.LookupSRV.
+func lookupSRV(ctx context.Context, name string) ([]*Instance, time.Duration, error) {
+	records, ttl, err := querySRV(ctx, name)
+	if err != nil {
+		_, addrs, lookupErr := net.DefaultResolver.LookupSRV(ctx, "", "", name)
+		if lookupErr != nil {
+			return nil, 0, lookupErr
+		}
+		records, ttl = addrs, srvFallbackRefresh
+	}
+
+	var instances []*Instance
+	for _, rec := range records {
+		if rec.Priority != records[0].Priority {
+			break
+		}
+		instances = append(instances, &Instance{
+			Addr:   net.JoinHostPort(strings.TrimSuffix(rec.Target, "."), strconv.Itoa(int(rec.Port))),
+			Weight: int(rec.Weight),
+		})
+	}
+	return instances, ttl, nil
+}
+
+// querySRV asks the system nameserver for SRV records of name over UDP.
+// Records come back sorted by priority.
+func querySRV(ctx context.Context, name string) ([]*net.SRV, time.Duration, error) {
+	server, err := systemNameserver()
+	if err != nil {
+		return nil, 0, err
+	}
+	qname, err := dnsmessage.NewName(dnsName(name))
+	if err != nil {
+		return nil, 0, err
+	}
+	id := uint16(rand.Intn(1 << 16))
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: qname, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+	buf := make([]byte, 4096)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(buf[:n]); err != nil {
+		return nil, 0, err
+	}
+	if msg.ID != id || msg.Truncated || msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, errors.New("unusable SRV response")
+	}
+
+	var records []*net.SRV
+	ttl := time.Duration(0)
+	for _, a := range msg.Answers {
+		srv, ok := a.Body.(*dnsmessage.SRVResource)
+		if !ok {
+			continue
+		}
+		records = append(records, &net.SRV{
+			Target:   srv.Target.String(),
+			Port:     srv.Port,
+			Priority: srv.Priority,
+			Weight:   srv.Weight,
+		})
+		if t := time.Duration(a.Header.TTL) * time.Second; ttl == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	if len(records) == 0 {
+		return nil, 0, fmt.Errorf("no SRV records for %s", name)
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Priority < records[j].Priority })
+	return records, ttl, nil
+}
+
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
+
+func systemNameserver() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// watchSRV re-resolves the SRV name whenever its records expire, keeping the
+// last known instances if a lookup fails
+func watchSRV(ctx context.Context, port int, sd SRVDiscovery) {
+	for ctx.Err() == nil {
+		instances, ttl, err := lookupSRV(ctx, sd.Name)
+		if err != nil {
+			log.Printf("SRV discovery for app %d: %v", port, err)
+			ttl = srvFallbackRefresh
+		} else {
+			setDiscovered(port, instances)
+		}
+		// Don't hammer the resolver for records with a zero or tiny TTL
+		if ttl < time.Second {
+			ttl = time.Second
+		}
+		select {
+		case <-time.After(ttl):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
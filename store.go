@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// UsageStore persists the apps, their usage counters and the API keys. The
+// in-memory usageData and apiKeys are the source of truth while running; the
+// store is read at startup and on reload, and written as they change, usage
+// by periodic flushes.
+type UsageStore interface {
+	// LoadApps returns every app, prepared, by port
+	LoadApps(ctx context.Context) (map[int]*App, error)
+	// RegisterApp stores an app without settings or usage for port, keeping
+	// any that already exists
+	RegisterApp(ctx context.Context, port int) error
+	// AddUsage adds the deltas to the stored counters of their apps. When
+	// only some of them failed it returns an *unwrittenDeltas naming those;
+	// for other errors none are taken as written.
+	AddUsage(ctx context.Context, deltas []*UsageDelta) error
+	// SetActivePool stores which blue-green pool of the app is active
+	SetActivePool(ctx context.Context, port int, color string) error
+	// LoadTenantUsage returns the usage of every tenant other than the
+	// default one
+	LoadTenantUsage(ctx context.Context) ([]*TenantUsage, error)
+	// SaveTenantUsage stores a tenant's usage of an app
+	SaveTenantUsage(ctx context.Context, u *TenantUsage) error
+	// AddUsageHistory adds the buckets' usage to the stored hourly buckets.
+	// When only some of them failed it returns an *unwrittenBuckets naming
+	// those; for other errors none are taken as written.
+	AddUsageHistory(ctx context.Context, buckets []*UsageBucket) error
+	// Rollup aggregates usage for q, calling emit with each row as it is
+	// read and stopping at its first error
+	Rollup(ctx context.Context, q RollupQuery, emit func(row map[string]any) error) error
+
+	// LoadAPIKeys returns every API key by key
+	LoadAPIKeys(ctx context.Context) (map[string]*APIKey, error)
+	InsertAPIKey(ctx context.Context, key *APIKey) error
+	// ExpireAPIKeys makes the principal's keys other than keep expire at
+	// cutoff, unless they expire sooner
+	ExpireAPIKeys(ctx context.Context, principal, keep string, cutoff time.Time) error
+	// DeleteAPIKey removes a key, reporting whether it was stored
+	DeleteAPIKey(ctx context.Context, key string) (bool, error)
+
+	// Ping checks that the store can be reached
+	Ping(ctx context.Context) error
+}
+
+// usageWriteTimeout bounds a single write to the store
+const usageWriteTimeout = 5 * time.Second
+
+// UsageDelta is the usage of an app counted since it was last stored. Count
+// and the bytes are added to the stored counters; the quota cycle, which
+// restarts, is stored as it stood at the last of the requests.
+type UsageDelta struct {
+	Port       int
+	Count      int
+	BytesIn    int64
+	BytesOut   int64
+	CycleCount int
+	CycleStart time.Time
+}
+
+// usageDeltas holds the usage per app port not yet written to the store. It
+// is guarded by the usageData lock, like the counters themselves.
+var usageDeltas = make(map[int]*UsageDelta)
+
+// addUsage adds a request to the app's unwritten usage; the caller must hold
+// the usageData lock, and the next flushUsage writes it
+func addUsage(app *App, in, out int64) {
+	d, ok := usageDeltas[app.Port]
+	if !ok {
+		d = &UsageDelta{Port: app.Port}
+		usageDeltas[app.Port] = d
+	}
+	d.Count++
+	d.BytesIn += in
+	d.BytesOut += out
+	d.CycleCount, d.CycleStart = app.CycleCount, app.CycleStart
+}
+
+// watchUsage flushes the apps' usage every interval (USAGE_FLUSH_INTERVAL)
+func watchUsage(store UsageStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		flushUsage(store)
+	}
+}
+
+// usageFlush keeps flushes from overlapping, so an older quota cycle is
+// never stored over a newer one
+var usageFlush sync.Mutex
+
+// flushUsage writes the usage counted since the last flush in batches of
+// USAGE_FLUSH_BATCH_SIZE apps, USAGE_FLUSH_CONCURRENCY at a time. Every app
+// is in exactly one batch, so the batches may land in any order. Requests
+// only add to the deltas under the usageData lock and never wait on the
+// store; while it is down nothing is written and the deltas keep adding up,
+// one per app.
+func flushUsage(store UsageStore) {
+	usageFlush.Lock()
+	defer usageFlush.Unlock()
+	if !storeUp.Load() {
+		return
+	}
+	usageData.Lock()
+	deltas := make([]*UsageDelta, 0, len(usageDeltas))
+	for _, d := range usageDeltas {
+		deltas = append(deltas, d)
+	}
+	usageDeltas = make(map[int]*UsageDelta)
+	usageData.Unlock()
+
+	slots := make(chan struct{}, config.UsageFlushConcurrency)
+	var wg sync.WaitGroup
+	for start := 0; start < len(deltas); start += config.UsageFlushBatchSize {
+		batch := deltas[start:min(start+config.UsageFlushBatchSize, len(deltas))]
+		slots <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			writeUsage(store, batch)
+			<-slots
+		}()
+	}
+	wg.Wait()
+
+	usageData.Lock()
+	pendingGauge.Set(float64(len(usageDeltas)))
+	usageData.Unlock()
+}
+
+// writeUsage writes a batch of deltas, putting back those that were not
+// written for the next flush. Only they are retried, so no increment is
+// applied twice.
+func writeUsage(store UsageStore, batch []*UsageDelta) {
+	ctx, cancel := context.WithTimeout(context.Background(), usageWriteTimeout)
+	defer cancel()
+	err := store.AddUsage(ctx, batch)
+	if err == nil {
+		return
+	}
+	failed := batch
+	var unwritten *unwrittenDeltas
+	if errors.As(err, &unwritten) {
+		failed = unwritten.deltas
+	} else {
+		setStoreUp(false)
+	}
+	log.Printf("Error storing the usage of %d of %d apps, retrying with the next flush: %v", len(failed), len(batch), err)
+	// Merged back into what was counted meanwhile, whose cycle is newer
+	usageData.Lock()
+	for _, d := range failed {
+		if cur, ok := usageDeltas[d.Port]; ok {
+			cur.Count += d.Count
+			cur.BytesIn += d.BytesIn
+			cur.BytesOut += d.BytesOut
+		} else {
+			usageDeltas[d.Port] = d
+		}
+	}
+	usageData.Unlock()
+}
+
+// unwrittenDeltas is returned by AddUsage when it knows that only some of
+// the deltas were not written
+type unwrittenDeltas struct {
+	deltas []*UsageDelta
+	err    error
+}
+
+func (e *unwrittenDeltas) Error() string { return e.err.Error() }
+func (e *unwrittenDeltas) Unwrap() error { return e.err }
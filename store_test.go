@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+// usageRecordingStore adds up the usage written to it. Ports in failPorts
+// are reported unwritten; with down set every write fails.
+type usageRecordingStore struct {
+	*memoryStore
+	mu        sync.Mutex
+	down      bool
+	failPorts map[int]bool
+	batches   int
+	counts    map[int]int
+}
+
+func (s *usageRecordingStore) AddUsage(ctx context.Context, deltas []*UsageDelta) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.down {
+		return errors.New("store unavailable")
+	}
+	s.batches++
+	var failed []*UsageDelta
+	for _, d := range deltas {
+		if s.failPorts[d.Port] {
+			failed = append(failed, d)
+			continue
+		}
+		s.counts[d.Port] += d.Count
+	}
+	if failed != nil {
+		return &unwrittenDeltas{deltas: failed, err: errors.New("write error")}
+	}
+	return nil
+}
+
+func TestFlushUsage(t *testing.T) {
+	config.UsageFlushBatchSize, config.UsageFlushConcurrency = 2, 2
+	store := &usageRecordingStore{memoryStore: newMemoryStore(""), failPorts: map[int]bool{41803: true}, counts: make(map[int]int)}
+	reset := func() {
+		usageData.Lock()
+		clear(usageDeltas)
+		usageData.Unlock()
+		setStoreUp(true)
+	}
+	// Only the deltas counted here are flushed
+	reset()
+	t.Cleanup(reset)
+	count := func(times int) {
+		usageData.Lock()
+		for port := 41801; port <= 41805; port++ {
+			for i := 0; i < times; i++ {
+				addUsage(&App{Port: port}, 1, 1)
+			}
+		}
+		usageData.Unlock()
+	}
+
+	count(2)
+	flushUsage(store)
+	if store.batches != 3 {
+		t.Errorf("5 apps written in %d batches, want 3", store.batches)
+	}
+	if store.counts[41801] != 2 || store.counts[41803] != 0 {
+		t.Fatalf("counts after the first flush = %v", store.counts)
+	}
+
+	// The unwritten delta is merged with what was counted since; a store
+	// that is down keeps everything for later
+	count(1)
+	store.down = true
+	flushUsage(store)
+	store.down, store.failPorts = false, nil
+	flushUsage(store)
+	setStoreUp(true)
+	flushUsage(store)
+	for port := 41801; port <= 41805; port++ {
+		if store.counts[port] != 3 {
+			t.Errorf("port %d stored %d requests, want 3", port, store.counts[port])
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	storeUpGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_store_up",
+		Help: "Whether the usage store (MongoDB) is reachable.",
+	})
+	pendingGauge = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_store_pending_apps",
+		Help: "Apps whose usage is waiting to be written to the usage store.",
+	})
+)
+
+// storeUp is false from a failed write or health check until a check passes
+var storeUp atomic.Bool
+
+func init() {
+	storeUp.Store(true)
+	storeUpGauge.Set(1)
+}
+
+func setStoreUp(up bool) {
+	if storeUp.Swap(up) != up {
+		if up {
+			log.Printf("Usage store is reachable again")
+		} else {
+			log.Printf("Usage store is unreachable; counts are kept in memory until it recovers")
+		}
+	}
+	if up {
+		storeUpGauge.Set(1)
+	} else {
+		storeUpGauge.Set(0)
+	}
+}
+
+// watchStore checks the store every interval, reconnecting being left to
+// the driver. Usage is only flushed while it is reachable.
+func watchStore(store UsageStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		ctx, cancel := context.WithTimeout(context.Background(), usageWriteTimeout)
+		err := store.Ping(ctx)
+		cancel()
+		setStoreUp(err == nil)
+	}
+}
+
+// readyHandler answers 200 while the usage store is reachable and 503 with
+// the number of apps waiting to be stored otherwise (GET /ready). The gateway
+// keeps proxying either way.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	usageData.Lock()
+	pending := len(usageDeltas)
+	usageData.Unlock()
+	if !storeUp.Load() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]any{"status": "degraded", "store": "down", "pending_apps": pending})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"status": "ok", "store": "up", "pending_apps": pending})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// TenantUsage is one tenant's usage of an app. Requests without a tenant are
+// only counted on the app itself, so a gateway that never sets one keeps no
+// tenant records.
+type TenantUsage struct {
+	Tenant   string `bson:"tenant" json:"tenant"`
+	Port     int    `bson:"port" json:"port"`
+	Count    int    `bson:"count" json:"count"`
+	BytesIn  int64  `bson:"bytes_in" json:"bytes_in"`
+	BytesOut int64  `bson:"bytes_out" json:"bytes_out"`
+}
+
+type tenantKey struct {
+	tenant string
+	port   int
+}
+
+func (u *TenantUsage) key() tenantKey { return tenantKey{u.Tenant, u.Port} }
+
+// tenantUsage holds the usage per tenant and app, and unsaved the records
+// changed since they were last written. Both are guarded by the usageData
+// lock, like the app counters.
+var (
+	tenantUsage  = make(map[tenantKey]*TenantUsage)
+	unsavedUsage = make(map[tenantKey]bool)
+)
+
+// requestTenant returns the tenant a request is counted against: that of the
+// API key it authenticated with, else the TENANT_HEADER header if it names a
+// tenant of TENANT_ALLOWLIST, else "" for the implicit default tenant
+func requestTenant(r *http.Request) string {
+	if key, ok := apiKeyFromRequest(r); ok && key.Tenant != "" {
+		return key.Tenant
+	}
+	if config.TenantHeader != "" {
+		if tenant := r.Header.Get(config.TenantHeader); slices.Contains(config.TenantAllowlist, tenant) {
+			return tenant
+		}
+	}
+	return ""
+}
+
+// countTenant adds a request to the tenant's usage of the app; the caller
+// must hold the usageData lock. The record is written by the next
+// flushTenantUsage.
+func countTenant(tenant string, port int, in, out int64) {
+	k := tenantKey{tenant, port}
+	u, ok := tenantUsage[k]
+	if !ok {
+		u = &TenantUsage{Tenant: tenant, Port: port}
+		tenantUsage[k] = u
+	}
+	u.Count++
+	u.BytesIn += in
+	u.BytesOut += out
+	unsavedUsage[k] = true
+}
+
+// watchTenantUsage flushes the tenant usage every interval
+// (TENANT_FLUSH_INTERVAL)
+func watchTenantUsage(store UsageStore, interval time.Duration) {
+	for range time.Tick(interval) {
+		flushTenantUsage(store)
+	}
+}
+
+// tenantFlush keeps flushes from overlapping, so an older copy of a record
+// is never written over a newer one
+var tenantFlush sync.Mutex
+
+// flushTenantUsage writes the tenant usage records changed since the last
+// flush. They are copied with usageData held and written without it, so
+// requests never wait on the store. While the store is down nothing is
+// written and the records stay unsaved; a failed write leaves the records
+// not yet written for the next flush.
+func flushTenantUsage(store UsageStore) {
+	tenantFlush.Lock()
+	defer tenantFlush.Unlock()
+	if !storeUp.Load() {
+		return
+	}
+	usageData.Lock()
+	changed := make([]TenantUsage, 0, len(unsavedUsage))
+	for k := range unsavedUsage {
+		changed = append(changed, *tenantUsage[k])
+	}
+	clear(unsavedUsage)
+	usageData.Unlock()
+
+	for i := range changed {
+		u := &changed[i]
+		ctx, cancel := context.WithTimeout(context.Background(), usageWriteTimeout)
+		err := store.SaveTenantUsage(ctx, u)
+		cancel()
+		if err == nil {
+			continue
+		}
+		log.Printf("Error updating stored count of tenant %q for port %d, retrying once the store is healthy: %v", u.Tenant, u.Port, err)
+		setStoreUp(false)
+		usageData.Lock()
+		for _, u := range changed[i:] {
+			unsavedUsage[u.key()] = true
+		}
+		usageData.Unlock()
+		return
+	}
+}
+
+// tenantUsageOf lists the tenant's usage by app, sorted by port
+func tenantUsageOf(tenant string) []TenantUsage {
+	usageData.Lock()
+	var usage []TenantUsage
+	for k, u := range tenantUsage {
+		if k.tenant == tenant {
+			usage = append(usage, *u)
+		}
+	}
+	usageData.Unlock()
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Port < usage[j].Port })
+	return usage
+}
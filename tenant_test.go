@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestRequestTenantAllowlist(t *testing.T) {
+	config.TenantHeader = "X-Tenant"
+	config.TenantAllowlist = []string{"acme"}
+	t.Cleanup(func() { config.TenantHeader, config.TenantAllowlist = "", nil })
+
+	for header, want := range map[string]string{"acme": "acme", "evil": "", "": ""} {
+		r, _ := http.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Tenant", header)
+		if got := requestTenant(r); got != want {
+			t.Errorf("tenant for header %q = %q, want %q", header, got, want)
+		}
+	}
+}
+
+// tenantRecordingStore remembers the tenant usage saved to it, failing while
+// fail is set
+type tenantRecordingStore struct {
+	*memoryStore
+	fail  bool
+	saved map[tenantKey]TenantUsage
+}
+
+func (s *tenantRecordingStore) SaveTenantUsage(ctx context.Context, u *TenantUsage) error {
+	if s.fail {
+		return errors.New("store unavailable")
+	}
+	s.saved[u.key()] = *u
+	return nil
+}
+
+func TestFlushTenantUsage(t *testing.T) {
+	store := &tenantRecordingStore{memoryStore: newMemoryStore(""), saved: make(map[tenantKey]TenantUsage)}
+	k := tenantKey{"flush-test", 41770}
+	t.Cleanup(func() {
+		usageData.Lock()
+		delete(tenantUsage, k)
+		delete(unsavedUsage, k)
+		usageData.Unlock()
+		setStoreUp(true)
+	})
+	count := func() {
+		usageData.Lock()
+		countTenant(k.tenant, k.port, 10, 20)
+		usageData.Unlock()
+	}
+
+	count()
+	if _, ok := store.saved[k]; ok {
+		t.Fatal("tenant usage written before the flush")
+	}
+	store.fail = true
+	flushTenantUsage(store)
+	count()
+
+	// The failed record is written once the store is back
+	store.fail = false
+	setStoreUp(true)
+	flushTenantUsage(store)
+	if got := store.saved[k]; got.Count != 2 || got.BytesIn != 20 || got.BytesOut != 40 {
+		t.Errorf("saved %+v, want both requests", got)
+	}
+	usageData.Lock()
+	unsaved := unsavedUsage[k]
+	usageData.Unlock()
+	if unsaved {
+		t.Error("record still unsaved after a successful flush")
+	}
+}
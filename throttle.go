@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	throttleActive = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_throttle_active",
+		Help: "Proxied requests holding one of the THROTTLE_LIMIT slots.",
+	})
+	throttleBacklog = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "gateway_throttle_backlog",
+		Help: "Proxied requests waiting in the THROTTLE_BACKLOG queue.",
+	})
+	throttleRejected = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gateway_throttle_rejected_total",
+		Help: "Proxied requests rejected because the throttle and its backlog were full or the wait timed out.",
+	})
+)
+
+// throttle bounds the requests the gateway works on at once across all apps,
+// protecting the process itself during spikes. Up to limit run, up to backlog
+// more wait for at most timeout, and the rest get 503 at once.
+func throttle(limit, backlog int, timeout time.Duration) func(http.Handler) http.Handler {
+	slots := make(chan struct{}, limit)
+	queue := make(chan struct{}, limit+backlog)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case queue <- struct{}{}:
+			default:
+				throttleRejected.Inc()
+				countShed(0, shedThrottle)
+				http.Error(w, "Server is busy", http.StatusServiceUnavailable)
+				return
+			}
+			defer func() { <-queue }()
+
+			select {
+			case slots <- struct{}{}:
+			default:
+				throttleBacklog.Inc()
+				timer := time.NewTimer(timeout)
+				select {
+				case slots <- struct{}{}:
+					timer.Stop()
+					throttleBacklog.Dec()
+				case <-timer.C:
+					throttleBacklog.Dec()
+					throttleRejected.Inc()
+					countShed(0, shedThrottle)
+					http.Error(w, "Timed out waiting for a free slot", http.StatusServiceUnavailable)
+					return
+				case <-r.Context().Done():
+					timer.Stop()
+					throttleBacklog.Dec()
+					return
+				}
+			}
+			throttleActive.Inc()
+			defer func() {
+				throttleActive.Dec()
+				<-slots
+			}()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// requestTimeout is a backstop for the whole request, whatever is slow: the
+// handler's context is canceled after d, and if nothing has been written by
+// then the client gets 503. Writes after that are dropped. It should be
+// longer than UPSTREAM_TIMEOUT and REQUEST_BUDGET so those answer first.
+func requestTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), d)
+			defer cancel()
+			tw := &timeoutWriter{w: w, h: make(http.Header)}
+			timer := time.AfterFunc(d, tw.timeout)
+			defer timer.Stop()
+
+			next.ServeHTTP(tw, r.WithContext(ctx))
+
+			tw.mu.Lock()
+			tw.done = true
+			tw.mu.Unlock()
+		})
+	}
+}
+
+// timeoutWriter serializes the handler's writes with the timeout response.
+// Headers are staged in h so the timeout never races with a handler still
+// setting them.
+type timeoutWriter struct {
+	w  http.ResponseWriter
+	h  http.Header
+	mu sync.Mutex
+	// wroteHeader is set once the response has started, timedOut once the
+	// 503 went out instead, done when the handler has returned
+	wroteHeader, timedOut, done bool
+}
+
+func (tw *timeoutWriter) Header() http.Header { return tw.h }
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	tw.writeHeader(status)
+}
+
+func (tw *timeoutWriter) writeHeader(status int) {
+	if tw.wroteHeader || tw.timedOut {
+		return
+	}
+	tw.wroteHeader = true
+	dst := tw.w.Header()
+	for k, v := range tw.h {
+		dst[k] = v
+	}
+	tw.w.WriteHeader(status)
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	tw.writeHeader(http.StatusOK)
+	return tw.w.Write(p)
+}
+
+func (tw *timeoutWriter) Flush() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if f, ok := tw.w.(http.Flusher); ok && !tw.timedOut {
+		f.Flush()
+	}
+}
+
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+	if tw.done || tw.wroteHeader {
+		return
+	}
+	tw.timedOut = true
+	http.Error(tw.w, "Request timed out", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+)
+
+// injectRequestFields sets the app's RequestFields on JSON object request
+// bodies, overwriting any value the client sent for them. Bodies that are not
+// application/json, not an object, or larger than REWRITE_MAX_BODY are
+// forwarded unchanged. The only error returned is from reading the body.
+func injectRequestFields(app *App, r *http.Request) error {
+	if app == nil || len(app.RequestFields) == 0 || r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mt != "application/json" {
+		return nil
+	}
+	limit := config.RewriteMaxBody
+	if r.ContentLength > limit {
+		return nil
+	}
+
+	orig := r.Body
+	buf, err := io.ReadAll(io.LimitReader(orig, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > limit {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(buf), orig), orig}
+		return nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(buf, &fields); err != nil || fields == nil {
+		// Not a JSON object; let the backend deal with it
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		return nil
+	}
+	for k, v := range app.RequestFields {
+		raw, err := json.Marshal(v)
+		if err != nil {
+			continue
+		}
+		fields[k] = raw
+	}
+	out, err := json.Marshal(fields)
+	if err != nil {
+		r.Body = io.NopCloser(bytes.NewReader(buf))
+		return nil
+	}
+
+	orig.Close()
+	r.Body = io.NopCloser(bytes.NewReader(out))
+	r.ContentLength = int64(len(out))
+	r.Header.Set("Content-Length", strconv.Itoa(len(out)))
+	r.Header.Del("Transfer-Encoding")
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// upstreamClient sends every proxied request. main rebuilds it once the
+// config is loaded.
+var upstreamClient = newUpstreamClient()
+
+// newUpstreamClient returns a client that never follows redirects, so a
+// backend's 3xx reaches the client as is
+func newUpstreamClient() *http.Client {
+	return &http.Client{
+		Transport: newUpstreamTransport(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func newUpstreamTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	dial := dialer.DialContext
+	if config.DNSCacheTTL > 0 {
+		upstreamDNS.ttl = config.DNSCacheTTL
+		dial = upstreamDNS.dialContext(dial)
+	}
+	t.DialContext = countingDialer(dial)
+	t.Proxy = upstreamProxy
+	// Warmed connections beyond the idle limit would be closed right away
+	if config.WarmupConns > http.DefaultMaxIdleConnsPerHost && config.WarmupConns > t.MaxIdleConnsPerHost {
+		t.MaxIdleConnsPerHost = config.WarmupConns
+	}
+	return t
+}
+
+// proxyOverride is an app's forward proxy setting; a nil url goes direct
+type proxyOverride struct {
+	url *url.URL
+}
+
+type proxyContextKey struct{}
+
+// withUpstreamProxy makes r go through the app's forward proxy; a nil
+// proxy sends it directly
+func withUpstreamProxy(r *http.Request, proxy *url.URL) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), proxyContextKey{}, proxy))
+}
+
+// upstreamProxy picks the forward proxy for an upstream request: the app's
+// UpstreamProxy when set, otherwise HTTP_PROXY/HTTPS_PROXY/NO_PROXY
+func upstreamProxy(r *http.Request) (*url.URL, error) {
+	if proxy, ok := r.Context().Value(proxyContextKey{}).(*url.URL); ok {
+		return proxy, nil
+	}
+	return http.ProxyFromEnvironment(r)
+}
+
+// parseUpstreamProxy parses App.UpstreamProxy. "direct" bypasses the
+// environment's proxy and yields a nil URL.
+func parseUpstreamProxy(v string) (*url.URL, error) {
+	if v == "direct" {
+		return nil, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("proxy URL %q has no host", v)
+	}
+	return u, nil
+}
+
+// countingDialer tracks open upstream connections in upstreamConnections
+func countingDialer(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		upstreamConnections.Inc()
+		return &trackedConn{Conn: c, gauge: upstreamConnections}, nil
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRelaysRedirects(t *testing.T) {
+	var followed bool
+	port := startBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/old") {
+			followed = true
+			return
+		}
+		http.Redirect(w, r, "/new?x=1", http.StatusFound)
+	})
+	gw := startGateway(t, appDoc(port))
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(fmt.Sprintf("%s/%d/old", gw.URL, port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Errorf("status = %d, want 302", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Location"); got != "/new?x=1" {
+		t.Errorf("Location = %q, want /new?x=1", got)
+	}
+	if followed {
+		t.Error("the gateway followed the redirect")
+	}
+}
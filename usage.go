@@ -0,0 +1,206 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_request_bytes_total",
+		Help: "Request body bytes received from clients, per app.",
+	}, []string{"app"})
+	responseBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "gateway_response_bytes_total",
+		Help: "Response body bytes sent to clients, per app.",
+	}, []string{"app"})
+
+	// Sizes from 64B to 16MiB, in steps of four
+	sizeBuckets  = prometheus.ExponentialBuckets(64, 4, 10)
+	requestSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_request_size_bytes",
+		Help:    "Request body sizes received from clients, per app.",
+		Buckets: sizeBuckets,
+	}, []string{"app"})
+	responseSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "gateway_response_size_bytes",
+		Help:    "Response body sizes sent to clients, per app.",
+		Buckets: sizeBuckets,
+	}, []string{"app"})
+)
+
+// errorBuckets counts an app's server errors over the last five minutes in
+// one-minute buckets, indexed by minute modulo five
+type errorBuckets struct {
+	minute [5]int64
+	count  [5]int
+}
+
+var recentErrors = struct {
+	sync.Mutex
+	m map[int]*errorBuckets
+}{m: make(map[int]*errorBuckets)}
+
+// recordError counts a 5xx answer for the app on port
+func recordError(port int, now time.Time) {
+	minute := now.Unix() / 60
+	i := minute % int64(len(errorBuckets{}.count))
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	b, ok := recentErrors.m[port]
+	if !ok {
+		b = &errorBuckets{}
+		recentErrors.m[port] = b
+	}
+	if b.minute[i] != minute {
+		b.minute[i], b.count[i] = minute, 0
+	}
+	b.count[i]++
+}
+
+// errorCount returns the app's 5xx answers in the last five minutes
+func errorCount(port int, now time.Time) int {
+	minute := now.Unix() / 60
+	recentErrors.Lock()
+	defer recentErrors.Unlock()
+	b, ok := recentErrors.m[port]
+	if !ok {
+		return 0
+	}
+	n := 0
+	for i, m := range b.minute {
+		if minute-m < int64(len(b.minute)) {
+			n += b.count[i]
+		}
+	}
+	return n
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// countBody wraps r's body, if it has one, so the bytes read from the client
+// can be accounted once the request is done
+func countBody(r *http.Request) *countingReader {
+	c := &countingReader{}
+	if r.Body != nil && r.Body != http.NoBody {
+		c.ReadCloser = r.Body
+		r.Body = c
+	}
+	return c
+}
+
+// countBytes adds a request's transfer to the app's metrics
+func countBytes(port int, in, out int64) {
+	label := strconv.Itoa(port)
+	requestBytes.WithLabelValues(label).Add(float64(in))
+	responseBytes.WithLabelValues(label).Add(float64(out))
+	requestSizes.WithLabelValues(label).Observe(float64(in))
+	responseSizes.WithLabelValues(label).Observe(float64(out))
+}
+
+type appUsage struct {
+	Port       int       `json:"port"`
+	Count      int       `json:"count"`
+	Quota      int       `json:"quota,omitempty"`
+	CycleCount int       `json:"cycle_count"`
+	CycleStart time.Time `json:"cycle_start"`
+	BytesIn    int64     `json:"bytes_in"`
+	BytesOut   int64     `json:"bytes_out"`
+}
+
+// appStatus is an app's usage plus live signals for triage
+type appStatus struct {
+	appUsage
+	InFlight int `json:"in_flight"`
+	Queued   int `json:"queued"`
+	// RecentErrors counts 5xx answers in the last five minutes
+	RecentErrors int `json:"recent_errors"`
+	// Circuit is the breaker state and Breaker its counters, omitted when
+	// the app has no breaker
+	Circuit string         `json:"circuit,omitempty"`
+	Breaker *breakerStatus `json:"breaker,omitempty"`
+}
+
+// appStatusHandler reports one app's usage with its in-flight requests,
+// recent errors and circuit state (GET /admin/usage/{port})
+func appStatusHandler(w http.ResponseWriter, r *http.Request) {
+	port, err := strconv.Atoi(chi.URLParam(r, "port"))
+	if err != nil {
+		jsonError(w, http.StatusBadRequest, "Invalid application ID")
+		return
+	}
+	usageData.Lock()
+	app, ok := usageData.Apps[port]
+	var status appStatus
+	var cs breakerSettings
+	if ok {
+		status.appUsage = usageOf(app)
+		cs = circuitSettings(app)
+	}
+	usageData.Unlock()
+	if !ok {
+		jsonError(w, http.StatusNotFound, "Unknown application")
+		return
+	}
+
+	status.InFlight, status.Queued = bulkheadFor(port).load()
+	status.RecentErrors = errorCount(port, time.Now())
+	if cs.failures > 0 {
+		bs := breakerFor(port).status(time.Now(), cs)
+		status.Circuit, status.Breaker = bs.State, &bs
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// usageOf copies the app's counters; the caller must hold the usageData lock
+func usageOf(app *App) appUsage {
+	return appUsage{
+		Port:       app.Port,
+		Count:      app.Count,
+		Quota:      app.Quota,
+		CycleCount: app.CycleCount,
+		CycleStart: app.CycleStart,
+		BytesIn:    app.BytesIn,
+		BytesOut:   app.BytesOut,
+	}
+}
+
+// usageHandler lists every app's usage (GET /admin/usage), or with
+// ?tenant= that tenant's usage of each app it has used
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		usage := tenantUsageOf(tenant)
+		if usage == nil {
+			usage = []TenantUsage{}
+		}
+		writeJSON(w, http.StatusOK, usage)
+		return
+	}
+	usageData.Lock()
+	usage := make([]appUsage, 0, len(usageData.Apps))
+	for _, app := range usageData.Apps {
+		usage = append(usage, usageOf(app))
+	}
+	usageData.Unlock()
+	sort.Slice(usage, func(i, j int) bool { return usage[i].Port < usage[j].Port })
+	writeJSON(w, http.StatusOK, usage)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// runValidate checks the configuration for -validate and prints every
+// problem found, without binding ports or connecting to MongoDB. Invalid
+// environment values have already stopped loadConfig. appsFile, when set, is
+// a mongoexport dump of the apps collection (one document per line) whose
+// app definitions are checked too; it defaults to APPS_FILE. It returns the
+// exit status.
+func runValidate(appsFile string) int {
+	errs := validateConfig()
+	if appsFile == "" {
+		appsFile = config.AppsFile
+	}
+	if appsFile != "" {
+		errs = append(errs, validateAppsFile(appsFile)...)
+	}
+	for _, err := range errs {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if len(errs) > 0 {
+		fmt.Fprintf(os.Stderr, "%d problem(s) found\n", len(errs))
+		return 1
+	}
+	fmt.Println("Configuration OK")
+	return 0
+}
+
+func validateConfig() []error {
+	var errs []error
+	if config.Storage == "mongo" {
+		for _, key := range []string{"MONGO_URI", "MONGO_DATABASE", "MONGO_COLLECTION"} {
+			if os.Getenv(key) == "" {
+				errs = append(errs, fmt.Errorf("%s is not set", key))
+			}
+		}
+		if uri := os.Getenv("MONGO_URI"); uri != "" {
+			if _, err := config.Mongo.clientOptions(uri); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	if err := checkPort("APP_PORT", config.AppPort); err != nil {
+		errs = append(errs, err)
+	}
+	if config.AdminPort != "" {
+		if err := checkPort("ADMIN_PORT", config.AdminPort); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if config.DefaultBackend != "" {
+		if err := checkHostPort(config.DefaultBackend); err != nil {
+			errs = append(errs, fmt.Errorf("DEFAULT_BACKEND: %v", err))
+		}
+	}
+	if err := checkDisabledMiddlewares(); err != nil {
+		errs = append(errs, err)
+	}
+
+	if config.Introspection.URL != "" {
+		if u, err := url.Parse(config.Introspection.URL); err != nil || !u.IsAbs() {
+			errs = append(errs, fmt.Errorf("INTROSPECTION_URL %q is not an absolute URL", config.Introspection.URL))
+		}
+	}
+	if config.HMAC.Enabled && config.HMAC.MaxSkew <= 0 {
+		errs = append(errs, fmt.Errorf("HMAC_MAX_SKEW must be positive when HMAC_AUTH is on"))
+	}
+
+	if config.ErrorPagesDir != "" {
+		if _, err := loadErrorPages(config.ErrorPagesDir); err != nil {
+			errs = append(errs, fmt.Errorf("ERROR_PAGES_DIR: %v", err))
+		}
+	}
+	if config.GeoIPDB != "" {
+		if err := openGeoIP(config.GeoIPDB); err != nil {
+			errs = append(errs, fmt.Errorf("GEOIP_DB: %v", err))
+		}
+	}
+	return errs
+}
+
+func validateAppsFile(path string) []error {
+	apps, errs := readAppsFile(path)
+	for _, app := range apps {
+		for _, err := range app.validate() {
+			errs = append(errs, fmt.Errorf("%s: app %d: %v", path, app.Port, err))
+		}
+	}
+	return errs
+}
+
+// readAppsFile reads app definitions from a mongoexport dump, one extended
+// JSON document per line. Lines that fail to decode are returned as errors
+// and skipped.
+func readAppsFile(path string) ([]*App, []error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, []error{err}
+	}
+	defer f.Close()
+
+	var apps []*App
+	var errs []error
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for line := 1; sc.Scan(); line++ {
+		doc := bytes.TrimSpace(sc.Bytes())
+		if len(doc) == 0 {
+			continue
+		}
+		var app App
+		if err := bson.UnmarshalExtJSON(doc, false, &app); err != nil {
+			errs = append(errs, fmt.Errorf("%s:%d: %v", path, line, err))
+			continue
+		}
+		apps = append(apps, &app)
+	}
+	if err := sc.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	return apps, errs
+}
+
+// validate returns the problems in the app's definition. At runtime these
+// are logged by prepare and the setting falls back or is disabled.
+func (app *App) validate() []error {
+	var errs []error
+	if app.Port < 1 || app.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535"))
+	}
+
+	upstreams := append([]string(nil), app.Instances...)
+	for _, cr := range app.ContentRoutes {
+		upstreams = append(upstreams, cr.Upstream)
+	}
+	if app.VersionRouting != nil {
+		for _, u := range app.VersionRouting.Upstreams {
+			upstreams = append(upstreams, u)
+		}
+	}
+	if app.Experiment != nil {
+		for _, v := range app.Experiment.Variants {
+			if v.Upstream != "" {
+				upstreams = append(upstreams, v.Upstream)
+			}
+		}
+	}
+	if app.BlueGreen != nil {
+		upstreams = append(upstreams, app.BlueGreen.Blue...)
+		upstreams = append(upstreams, app.BlueGreen.Green...)
+	}
+	for _, u := range upstreams {
+		if err := checkHostPort(u); err != nil {
+			errs = append(errs, fmt.Errorf("backend: %v", err))
+		}
+	}
+
+	if app.UpstreamProxy != "" {
+		if _, err := parseUpstreamProxy(app.UpstreamProxy); err != nil {
+			errs = append(errs, fmt.Errorf("upstream proxy: %v", err))
+		}
+	}
+	for _, name := range app.Auth {
+		if _, ok := newAuthenticator(name); !ok {
+			errs = append(errs, fmt.Errorf("unknown or unconfigured auth scheme %q", name))
+		}
+	}
+	if rl := app.RateLimit; rl != nil {
+		if !rl.knownAlgorithm() {
+			errs = append(errs, fmt.Errorf("unknown rate limit algorithm %q", rl.Algorithm))
+		}
+		if !rl.enabled() {
+			errs = append(errs, fmt.Errorf("rate limit is incomplete"))
+		}
+	}
+	if bl := app.BodyLogging; bl != nil && (bl.SampleRate < 0 || bl.MaxBytes < 0) {
+		errs = append(errs, fmt.Errorf("body logging sample rate and max bytes must not be negative"))
+	}
+	if hc := app.HealthCheck; hc != nil {
+		if hc.Path != "" && !strings.HasPrefix(hc.Path, "/") {
+			errs = append(errs, fmt.Errorf("health check path %q must start with /", hc.Path))
+		}
+		if hc.ExpectedStatus != 0 && (hc.ExpectedStatus < 100 || hc.ExpectedStatus > 599) {
+			errs = append(errs, fmt.Errorf("health check expected status %d is not an HTTP status", hc.ExpectedStatus))
+		}
+		if hc.IntervalMS < 0 || hc.TimeoutMS < 0 || hc.HealthyThreshold < 0 || hc.UnhealthyThreshold < 0 {
+			errs = append(errs, fmt.Errorf("health check interval, timeout and thresholds must not be negative"))
+		}
+	}
+	if c := app.Circuit; c != nil && (c.Failures < 0 || c.WindowMS < 0 || c.CooldownMS < 0 || c.HalfOpenProbes < 0) {
+		errs = append(errs, fmt.Errorf("circuit breaker failures, window, cooldown and probes must not be negative"))
+	}
+	if strings.ContainsAny(app.UpstreamHost, " /\r\n") {
+		errs = append(errs, fmt.Errorf("upstream host %q is not a host", app.UpstreamHost))
+	}
+	if ir := app.InternalRedirect; ir != nil {
+		if ir.Upstream != "" {
+			if err := checkHostPort(ir.Upstream); err != nil {
+				errs = append(errs, fmt.Errorf("internal redirect upstream: %v", err))
+			}
+		}
+		if ir.MaxRedirects < 0 {
+			errs = append(errs, fmt.Errorf("internal redirect max redirects must not be negative"))
+		}
+	}
+	if app.LoadBalancing != nil && !knownStrategy(app.LoadBalancing.Strategy) {
+		errs = append(errs, fmt.Errorf("unknown load balancing strategy %q", app.LoadBalancing.Strategy))
+	}
+	for _, rule := range app.ResponseRewrites {
+		if _, err := regexp.Compile(rule.Pattern); err != nil {
+			errs = append(errs, fmt.Errorf("rewrite pattern %q: %v", rule.Pattern, err))
+		}
+	}
+	return errs
+}
+
+func checkPort(key, v string) error {
+	port, err := strconv.Atoi(v)
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("%s %q is not a valid port", key, v)
+	}
+	return nil
+}
+
+func checkHostPort(addr string) error {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%q is not host:port", addr)
+	}
+	if host == "" {
+		return fmt.Errorf("%q has no host", addr)
+	}
+	return checkPort("port of "+addr, port)
+}
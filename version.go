@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"runtime"
+	"time"
+)
+
+// Build information, injected at build time with e.g.
+//
+//	go build -ldflags "-X main.version=1.4.0 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+var startTime = time.Now()
+
+// versionHandler reports which build is running (GET /version, open like
+// /ready, on the main and the admin listener, and GET /admin/version)
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+		"go_version": runtime.Version(),
+		"uptime":     time.Since(startTime).Round(time.Second).String(),
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionEndpoint(t *testing.T) {
+	gw := startGateway(t)
+
+	resp, body := get(t, gw, "/version")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /version: status %d", resp.StatusCode)
+	}
+	var info map[string]string
+	if err := json.Unmarshal([]byte(body), &info); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{"version", "commit", "build_time", "go_version", "uptime"} {
+		if info[field] == "" {
+			t.Errorf("%s missing from %s", field, body)
+		}
+	}
+	if code := adminGet(t, gw, "/admin/version", nil); code != http.StatusOK {
+		t.Errorf("GET /admin/version: status %d", code)
+	}
+}
+
+func TestVersionOnAdminListener(t *testing.T) {
+	t.Setenv("ADMIN_PORT", "9999")
+	admin := httptest.NewServer(newTestServer(t).AdminHandler())
+	defer admin.Close()
+
+	if resp, _ := get(t, admin, "/version"); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /version on the admin listener: status %d", resp.StatusCode)
+	}
+}
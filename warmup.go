@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// warmTarget is a backend to warm and the forward proxy its app reaches it
+// through, if it overrides the environment's
+type warmTarget struct {
+	addr  string
+	proxy *proxyOverride
+}
+
+// warmup tracks the backends already warmed, and those being warmed or
+// waiting for a retry, so reloads only warm new ones
+var warmup = struct {
+	sync.Mutex
+	done    map[string]bool
+	pending map[string]bool
+}{done: make(map[string]bool), pending: make(map[string]bool)}
+
+// warmUpstreams opens WARMUP_CONNS connections to every backend of the apps
+// not warmed yet, so the first requests don't pay for dialing. Connections
+// are opened with concurrent HEAD requests for WARMUP_PATH and left in the
+// upstream client's idle pool. Backends that can't be reached are retried
+// every WARMUP_RETRY_INTERVAL while any app still uses them.
+func warmUpstreams() {
+	for _, t := range warmTargets() {
+		if isSelf(t.addr) {
+			continue
+		}
+		warmup.Lock()
+		start := !warmup.done[t.addr] && !warmup.pending[t.addr]
+		warmup.pending[t.addr] = true
+		warmup.Unlock()
+		if start {
+			go warm(t)
+		}
+	}
+}
+
+// warmTargets lists the backends of every app
+func warmTargets() []warmTarget {
+	usageData.Lock()
+	defer usageData.Unlock()
+	var targets []warmTarget
+	for port, app := range usageData.Apps {
+		for _, in := range appInstances(app, port) {
+			targets = append(targets, warmTarget{addr: in.Addr, proxy: app.upstreamProxy})
+		}
+	}
+	return targets
+}
+
+func warm(t warmTarget) {
+	for attempt := 1; ; attempt++ {
+		err := warmConns(t, config.WarmupConns)
+		if err == nil {
+			warmup.Lock()
+			warmup.done[t.addr] = true
+			delete(warmup.pending, t.addr)
+			warmup.Unlock()
+			if attempt > 1 {
+				log.Printf("Warmed up connections to %s", t.addr)
+			}
+			return
+		}
+		if attempt == 1 {
+			log.Printf("Error warming up connections to %s, retrying every %s: %v", t.addr, config.WarmupRetryInterval, err)
+		}
+		time.Sleep(config.WarmupRetryInterval)
+		if !stillServed(t.addr) {
+			warmup.Lock()
+			delete(warmup.pending, t.addr)
+			warmup.Unlock()
+			return
+		}
+	}
+}
+
+// warmConns sends n concurrent requests so the client opens n connections,
+// succeeding if any of them got a response
+func warmConns(t warmTarget, n int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+t.addr+config.WarmupPath, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if t.proxy != nil {
+				req = withUpstreamProxy(req, t.proxy.url)
+			}
+			resp, err := upstreamClient.Do(req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			// Drained so the connection goes back to the pool
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			errs <- nil
+		}()
+	}
+	var last error
+	ok := false
+	for i := 0; i < n; i++ {
+		if err := <-errs; err == nil {
+			ok = true
+		} else {
+			last = err
+		}
+	}
+	if ok {
+		return nil
+	}
+	return last
+}
+
+func stillServed(addr string) bool {
+	for _, t := range warmTargets() {
+		if t.addr == addr {
+			return true
+		}
+	}
+	return false
+}